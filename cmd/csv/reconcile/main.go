@@ -2,6 +2,7 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/csv"
 	"flag"
 	"fmt"
@@ -10,53 +11,20 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/profile"
 )
 
 var (
-	csvFile   = flag.String("csv", "", "path of cleaned csv.gz input")
-	canvasDir = flag.String("datadir", "", "path of canvas_*.zip files")
+	csvFile     = flag.String("csv", "", "path of cleaned csv.gz input")
+	canvasDir   = flag.String("datadir", "", "path of canvas_*.zip files")
+	profileName = flag.String("profile", profile.Default, "canvas profile: 2017, 2022 or 2023")
+	frames      = flag.String("frames", "", "comma-separated canvas zips, tars, PNG directories or globs to use instead of -datadir")
 )
 
-var colorToId = map[string]uint8{
-	"#6D001A": 0,
-	"#BE0039": 1,
-	"#FF4500": 2,
-	"#FFA800": 3,
-	"#FFD635": 4,
-	"#FFF8B8": 5,
-	"#00A368": 6,
-	"#00CC78": 7,
-	"#7EED56": 8,
-	"#00756F": 9,
-	"#009EAA": 10,
-	"#00CCC0": 11,
-	"#2450A4": 12,
-	"#3690EA": 13,
-	"#51E9F4": 14,
-	"#493AC1": 15,
-	"#6A5CFF": 16,
-	"#94B3FF": 17,
-	"#811E9F": 18,
-	"#B44AC0": 19,
-	"#E4ABFF": 20,
-	"#DE107F": 21,
-	"#FF3881": 22,
-	"#FF99AA": 23,
-	"#6D482F": 24,
-	"#9C6926": 25,
-	"#FFB470": 26,
-	"#000000": 27,
-	"#515252": 28,
-	"#898D90": 29,
-	"#D4D7D9": 30,
-	"#FFFFFF": 31,
-}
-
 func main() {
 	flag.Parse()
 
@@ -75,41 +43,39 @@ func main() {
 
 	cr := csv.NewReader(f)
 
-	dr, err := delta.MakeDeltaReader(filepath.Join(*canvasDir, "canvas_full.zip"),
+	patterns := []string{filepath.Join(*canvasDir, "canvas_full.zip"),
 		filepath.Join(*canvasDir, "canvas_delta.zip"),
-		filepath.Join(*canvasDir, "canvas_ticks.zip"),
-	)
-
-	if err != nil {
-		log.Fatal(err)
+		filepath.Join(*canvasDir, "canvas_ticks*.zip"),
+	}
+	if *frames != "" {
+		patterns = strings.Split(*frames, ",")
 	}
 
-	lastImage, err := dr.GetImage(&dr.Files[0][len(dr.Files[0])-1])
+	p, err := profile.Lookup(*profileName)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// snaps is an ordered list of every canvas stored in delta format
-	snaps := append([]delta.DeltaReaderEntry{}, dr.Files[0]...)
-	snaps = append(snaps, dr.Files[1]...)
-	snaps = append(snaps, dr.Files[2]...)
-	snaps = append(snaps, dr.Files[3]...)
-	sort.Slice(snaps, func(i, j int) bool {
-		return snaps[i].Ts < snaps[j].Ts
-	})
+	dr, err := delta.MakeDeltaReader(p, patterns...)
 
-	snapN := 0
-	s := &snaps[snapN]
-	si, err := dr.GetImage(s)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	state := image.NewPaletted(lastImage.Rect, lastImage.Palette)
+	// snaps walks every canvas stored in delta format in time order
+	snaps := dr.Frames(context.Background(), 0, 0)
+	if !snaps.Next() {
+		log.Fatal("no snapshots ", snaps.Err())
+	}
+	snapN := 0
+	s := snaps.Frame().Entry
+	si := snaps.Frame().Image
+
+	state := image.NewPaletted(p.Bounds(), p.Palette)
 	for i := 0; i < len(state.Pix); i++ {
-		state.Pix[i] = 32
+		state.Pix[i] = p.Blank
 	}
-	fmt.Println(len(lastImage.Palette))
+	fmt.Println(p.Pal, p.Pal.Len())
 
 	for {
 		rec, err := cr.Read()
@@ -128,36 +94,42 @@ func main() {
 			log.Fatal(err)
 		}
 
-		if ts >= s.Ts {
-			for y := 0; y < 1000; y++ {
-				for x := 0; x < 1000; x++ {
-					wc := si.ColorIndexAt(x, y)
-					sc := state.ColorIndexAt(x+1000*(s.Canvas%2), y+1000*(s.Canvas/2))
-					if wc != sc {
-						fmt.Printf("WHAT snap:%d @ %d (%d,%d) wc:%d sc:%d\n", snapN, s.Ts, x, y, wc, sc)
-						state.SetColorIndex(x+1000*(s.Canvas%2), y+1000*(s.Canvas/2), wc)
+		// once past the last snapshot there's nothing left to compare against
+		if s != nil {
+			o := p.Offsets[s.Canvas]
+			if ts >= s.Ts {
+				for y := 0; y < p.TileHeight; y++ {
+					for x := 0; x < p.TileWidth; x++ {
+						wc := si.ColorIndexAt(x, y)
+						sc := state.ColorIndexAt(x+o.X, y+o.Y)
+						if wc != sc {
+							fmt.Printf("WHAT snap:%d @ %d (%d,%d) wc:%d sc:%d\n", snapN, s.Ts, x, y, wc, sc)
+							state.SetColorIndex(x+o.X, y+o.Y, wc)
+						}
 					}
 				}
-			}
-			snapN++
-			s = &snaps[snapN]
-			si, err = dr.GetImage(s)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			mm := 0
-			for y := 0; y < 1000; y++ {
-				for x := 0; x < 1000; x++ {
-					wc := si.ColorIndexAt(x, y)
-					sc := state.ColorIndexAt(x+1000*(s.Canvas%2), y+1000*(s.Canvas/2))
-					if wc != sc {
-						mm++
+				snapN++
+				s, si = nil, nil
+				if snaps.Next() {
+					s = snaps.Frame().Entry
+					si = snaps.Frame().Image
+				} else if snaps.Err() != nil {
+					log.Fatal(snaps.Err())
+				}
+			} else {
+				mm := 0
+				for y := 0; y < p.TileHeight; y++ {
+					for x := 0; x < p.TileWidth; x++ {
+						wc := si.ColorIndexAt(x, y)
+						sc := state.ColorIndexAt(x+o.X, y+o.Y)
+						if wc != sc {
+							mm++
+						}
 					}
 				}
-			}
-			if mm == 0 {
-				fmt.Printf("SNAP %d ACTUALLY CAPTURED AT %d\n", s.Ts, ts)
+				if mm == 0 {
+					fmt.Printf("SNAP %d ACTUALLY CAPTURED AT %d\n", s.Ts, ts)
+				}
 			}
 		}
 
@@ -175,11 +147,11 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		color, ok := colorToId[rec[2]]
+		color, ok := p.Pal.Index(rec[2])
 		if !ok {
 			log.Fatal("unknown color", rec[2])
 		}
 
-		state.SetColorIndex(x, y, color+1) // 0 is transparent
+		state.SetColorIndex(x, y, color)
 	}
 }
@@ -0,0 +1,164 @@
+// compare PNG and sparse delta encodings of the deltas in canvas zips: stored
+// size, and how long each takes to decode and apply onto its base.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/profile"
+)
+
+var (
+	dataDir     = flag.String("datadir", ".", "directory holding canvas zips")
+	frames      = flag.String("frames", "", "comma-separated canvas zips, tars, PNG directories or globs to use instead of the zips in -datadir")
+	profileName = flag.String("profile", profile.Default, "canvas profile: 2017, 2022 or 2023")
+	sample      = flag.Int("n", 2000, "compare at most this many deltas, spread evenly over the archive (0 for all)")
+)
+
+type stats struct {
+	bytes, deflated int64
+	decode, apply   time.Duration
+}
+
+func (s *stats) print(name string, n int) {
+	fmt.Printf("%-6s %10.2fMiB %10.2fMiB %10.1fKiB %12s %12s\n", name,
+		float64(s.bytes)/1024/1024, float64(s.deflated)/1024/1024, float64(s.bytes)/1024/float64(n),
+		s.decode/time.Duration(n), s.apply/time.Duration(n))
+}
+
+func deflatedSize(b []byte) int64 {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write(b)
+	fw.Close()
+	return int64(buf.Len())
+}
+
+func main() {
+	flag.Parse()
+
+	p, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	patterns := []string{
+		filepath.Join(*dataDir, "canvas_full.zip"),
+		filepath.Join(*dataDir, "canvas_delta*.zip"),
+		filepath.Join(*dataDir, "canvas_ticks*.zip"),
+	}
+	if *frames != "" {
+		patterns = strings.Split(*frames, ",")
+	}
+
+	dr, err := delta.MakeDeltaReader(p, patterns...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dr.Close()
+
+	var deltas []*delta.DeltaReaderEntry
+	for c := range dr.Files {
+		for i := range dr.Files[c] {
+			if dr.Files[c][i].Prev != 0 {
+				deltas = append(deltas, &dr.Files[c][i])
+			}
+		}
+	}
+	if len(deltas) == 0 {
+		log.Fatal("no deltas found")
+	}
+	if *sample > 0 && len(deltas) > *sample {
+		picked := make([]*delta.DeltaReaderEntry, *sample)
+		for i := range picked {
+			picked[i] = deltas[i*len(deltas) / *sample]
+		}
+		deltas = picked
+	}
+
+	base := image.NewPaletted(p.TileRect(0).Sub(p.Offsets[0]), p.Palette)
+	for i := range base.Pix {
+		base.Pix[i] = p.Blank
+	}
+
+	var ps, ss stats
+	changed := 0
+	for n, e := range deltas {
+		r, err := e.Open()
+		if err != nil {
+			log.Fatal(err)
+		}
+		raw, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			log.Fatal(e.Name, err)
+		}
+
+		var pngBytes, spdBytes []byte
+		if e.IsSparse() {
+			spdBytes = raw
+			im, err := e.Read()
+			if err != nil {
+				log.Fatal(err)
+			}
+			var buf bytes.Buffer
+			png.Encode(&buf, im)
+			pngBytes = buf.Bytes()
+		} else {
+			pngBytes = raw
+			s, err := e.ReadSparse()
+			if err != nil {
+				log.Fatal(err)
+			}
+			var buf bytes.Buffer
+			delta.EncodeSparse(&buf, s)
+			spdBytes = buf.Bytes()
+		}
+
+		start := time.Now()
+		im, err := delta.DecodePaletted(bytes.NewReader(pngBytes), p.Palette)
+		if err != nil {
+			log.Fatal(e.Name, err)
+		}
+		decoded := time.Now()
+		delta.ApplyDelta(base, im)
+		ps.decode += decoded.Sub(start)
+		ps.apply += time.Since(decoded)
+		ps.bytes += int64(len(pngBytes))
+		ps.deflated += deflatedSize(pngBytes)
+
+		start = time.Now()
+		s, err := delta.DecodeSparse(bytes.NewReader(spdBytes), p.Palette)
+		if err != nil {
+			log.Fatal(e.Name, err)
+		}
+		decoded = time.Now()
+		delta.ApplySparse(base, s)
+		ss.decode += decoded.Sub(start)
+		ss.apply += time.Since(decoded)
+		ss.bytes += int64(len(spdBytes))
+		ss.deflated += deflatedSize(spdBytes)
+
+		changed += s.Changed()
+		if n%100 == 0 {
+			fmt.Printf("%d/%d\r", n, len(deltas))
+		}
+	}
+
+	fmt.Printf("%d deltas, %.0f changed pixels each on average\n", len(deltas), float64(changed)/float64(len(deltas)))
+	fmt.Printf("%-6s %13s %13s %13s %12s %12s\n", "format", "size", "deflated", "avg size", "avg decode", "avg apply")
+	ps.print("png", len(deltas))
+	ss.print("spd", len(deltas))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"flag"
 	"fmt"
@@ -12,9 +13,9 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime/pprof"
-	"sort"
 
 	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/profile"
 )
 
 var (
@@ -25,6 +26,7 @@ var (
 	crunchSplit = flag.Int("crunchsplit", 0, "split crunch bins into segments this many seconds long")
 	canvasDir   = flag.String("datadir", "", "path of canvas_*.zip files")
 	cpuprofile  = flag.String("cpuprofile", "", "write cpu profile to file")
+	profileName = flag.String("profile", "2022", "canvas profile: 2017, 2022 or 2023")
 )
 
 func writeEventsBinary() {
@@ -32,9 +34,14 @@ func writeEventsBinary() {
 		log.Fatal("-datadir is required")
 	}
 
-	dr, err := delta.MakeDeltaReader(filepath.Join(*canvasDir, "canvas_full.zip"),
+	p, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dr, err := delta.MakeDeltaReader(p, filepath.Join(*canvasDir, "canvas_full.zip"),
 		filepath.Join(*canvasDir, "canvas_delta.zip"),
-		filepath.Join(*canvasDir, "canvas_ticks.zip"),
+		filepath.Join(*canvasDir, "canvas_ticks*.zip"),
 	)
 
 	if err != nil {
@@ -49,39 +56,27 @@ func writeEventsBinary() {
 	w := bufio.NewWriter(wf)
 	defer w.Flush()
 
-	// snaps is an ordered list of every canvas stored in delta format
-	snaps := append([]delta.DeltaReaderEntry{}, dr.Files[0]...)
-	snaps = append(snaps, dr.Files[1]...)
-	snaps = append(snaps, dr.Files[2]...)
-	snaps = append(snaps, dr.Files[3]...)
-	sort.Slice(snaps, func(i, j int) bool {
-		return snaps[i].Ts < snaps[j].Ts
-	})
+	// snaps walks every canvas stored in delta format in time order
+	snaps := dr.Frames(context.Background(), 0, 0)
 
 	w.Write([]byte("PIXELPAK"))
 
 	var buf [8]byte
-	start_time := uint64(1648817050351)
+	start_time := uint64(p.Start)
 	binary.LittleEndian.PutUint64(buf[:8], start_time)
 	w.Write(buf[:8])
 
-	firstImage, err := dr.GetImage(&dr.Files[0][0])
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	state := image.NewPaletted(image.Rect(0, 0, 2000, 2000), firstImage.Palette)
+	state := image.NewPaletted(p.Bounds(), p.Palette)
 	for i := 0; i < len(state.Pix); i++ {
-		state.Pix[i] = 32
+		state.Pix[i] = p.Blank
 	}
+	width := p.Width()
 
 	ev := 0
 
-	for snapN, s := range snaps {
-		si, err := dr.GetImage(&s)
-		if err != nil {
-			log.Fatal(err)
-		}
+	for snapN := 0; snaps.Next(); snapN++ {
+		s := snaps.Frame().Entry
+		si := snaps.Frame().Image
 
 		if snapN == 5000 {
 			break
@@ -89,13 +84,14 @@ func writeEventsBinary() {
 
 		binary.LittleEndian.PutUint32(buf[4:], uint32(uint64(s.Ts)-start_time))
 
-		for y := 0; y < 1000; y++ {
-			for x := 0; x < 1000; x++ {
-				ox := x + 1000*(s.Canvas%2)
-				oy := y + 1000*(s.Canvas/2)
+		o := p.Offsets[s.Canvas]
+		for y := 0; y < p.TileHeight; y++ {
+			for x := 0; x < p.TileWidth; x++ {
+				ox := x + o.X
+				oy := y + o.Y
 
-				wc := si.Pix[x+y*1000]
-				sc := state.Pix[ox+oy*2000]
+				wc := si.Pix[x+y*p.TileWidth]
+				sc := state.Pix[ox+oy*width]
 
 				if wc != sc {
 					ev++
@@ -114,18 +110,19 @@ func writeEventsBinary() {
 
 		// if snapN > 1000 {break}
 
-		fmt.Printf("%d/%d %d %d\r", snapN, len(snaps), ev, s.Ts)
+		fmt.Printf("%d/%d %d %d\r", snapN, snaps.Len(), ev, s.Ts)
+	}
+	if err := snaps.Err(); err != nil {
+		log.Fatal(err)
 	}
-}
-
-var palette = []string{
-	"#6D001A", "#BE0039", "#FF4500", "#FFA800", "#FFD635", "#FFF8B8", "#00A368", "#00CC78",
-	"#7EED56", "#00756F", "#009EAA", "#00CCC0", "#2450A4", "#3690EA", "#51E9F4", "#493AC1",
-	"#6A5CFF", "#94B3FF", "#811E9F", "#B44AC0", "#E4ABFF", "#DE107F", "#FF3881", "#FF99AA",
-	"#6D482F", "#9C6926", "#FFB470", "#000000", "#515252", "#898D90", "#D4D7D9", "#FFFFFF",
 }
 
 func readEventsBinary() {
+	p, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	r, err := os.Open(*inFile)
 	if err != nil {
 		log.Fatal(err)
@@ -164,11 +161,21 @@ func readEventsBinary() {
 		packed := binary.LittleEndian.Uint32(buf[:4])
 		time_offset := binary.LittleEndian.Uint32(buf[4:])
 
-		fmt.Fprintf(w, "%d,%s,%d,%d\n", start_time+uint64(time_offset), palette[(packed>>22)&31], packed&0x7FF, (packed>>11)&0x7FF)
+		fmt.Fprintf(w, "%d,%s,%d,%d\n", start_time+uint64(time_offset), p.Pal.Hex(uint8((packed>>22)&31)+1), packed&0x7FF, (packed>>11)&0x7FF)
 	}
 }
 
 func crunchEventsBinary() {
+	p, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the 3 bit octants only reach 2000x2000; eventsfromcanvas2 crunches larger canvases
+	width, height := p.Width(), p.Height()
+	if width > 2000 || height > 2000 {
+		log.Fatalf("%s canvas is %dx%d, too big to crunch into 3 bit octants", p.Name, width, height)
+	}
+
 	r, err := os.Open(*inFile)
 	if err != nil {
 		log.Fatal(err)
@@ -244,7 +251,7 @@ func crunchEventsBinary() {
 
 	writeHeader()
 
-	ocs := make([]uint8, 2000*2000)
+	ocs := make([]uint8, width*height)
 	for i := range ocs {
 		ocs[i] = 31
 	}
@@ -264,7 +271,7 @@ func crunchEventsBinary() {
 		y := (packed >> 11) & 0x7FF
 		oct := x/1000 + 2*(y/500)
 
-		ocs[x+y*2000] ^= uint8(new_color ^ old_color)
+		ocs[int(x)+int(y)*width] ^= uint8(new_color ^ old_color)
 
 		if uint64(timeOffset) != curTs || oct != curOct {
 			writeChunk()
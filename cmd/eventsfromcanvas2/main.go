@@ -4,8 +4,10 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
@@ -20,6 +22,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/profile"
 )
 
 var (
@@ -34,9 +39,13 @@ var (
 	average     = flag.Bool("average", false, "produce an averaged image of the given time period")
 	crunchSplit = flag.Int("crunchsplit", 0, "split crunch bins into segments this many seconds long")
 	canvasDir   = flag.String("datadir", "", "path of canvas_*.zip files")
+	frames      = flag.String("frames", "", "comma-separated canvas zips, tars, PNG directories or globs to read through a DeltaReader instead of -datadir")
 	cpuprofile  = flag.String("cpuprofile", "", "write cpu profile to file")
+	profileName = flag.String("profile", profile.Default, "canvas profile: 2017, 2022 or 2023")
 )
 
+var prof *profile.Profile
+
 type Snapshot struct {
 	key  SnapKey
 	name string
@@ -67,11 +76,11 @@ func (k SnapKey) C() int {
 
 func (k SnapKey) OffsetX() int {
 	c, _ := k.Split()
-	return (c % 3) * 1000
+	return prof.Offsets[c].X
 }
 func (k SnapKey) OffsetY() int {
 	c, _ := k.Split()
-	return (c / 3) * 1000
+	return prof.Offsets[c].Y
 }
 
 func (s SnapKey) String() string {
@@ -129,31 +138,6 @@ func (i *ImageStitcher) GetSnap(c int, ts int64) *Snapshot {
 	return i.snaps[GetKey(c, ts)]
 }
 
-func ApplyDelta(base, delta *image.Paletted) *image.Paletted {
-	if !base.Rect.Eq(delta.Rect) {
-		panic("applying delta onto wrong-sized base")
-	}
-	combined := image.NewPaletted(base.Rect, base.Palette)
-	copy(combined.Pix, base.Pix)
-	_, _, _, a := delta.Palette[0].RGBA()
-	if a != 0 {
-		panic("expected transparency to be zero")
-	}
-	if len(delta.Palette) != 33 {
-		panic(fmt.Sprintf("delta bad len %d", len(delta.Palette)))
-	}
-	if len(base.Palette) != 33 {
-		panic(fmt.Sprintf("base bad len %d", len(base.Palette)))
-	}
-	for i := 0; i < len(delta.Pix); i++ {
-		if ci := delta.Pix[i]; ci > 0 {
-			//combined.Pix[i] = uint8(combined.Palette.Index(delta.Palette[delta.Pix[i]]))
-			combined.Pix[i] = ci
-		}
-	}
-	return combined
-}
-
 func (i *ImageStitcher) GetImage(k SnapKey) (*image.Paletted, error) {
 	s := i.snaps[k]
 	if s == nil {
@@ -178,14 +162,15 @@ func (i *ImageStitcher) GetImage(k SnapKey) (*image.Paletted, error) {
 	if err != nil {
 		log.Fatal(s, err)
 	}
-	im, err := png.Decode(f)
+	pi, err = delta.DecodePaletted(f, prof.Palette)
 	f.Close()
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", s.name, err)
 	}
-	pi = im.(*image.Paletted)
 	if base != nil {
-		pi = ApplyDelta(base, pi)
+		if pi, err = delta.ApplyDelta(base, pi); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.name, err)
+		}
 	}
 	ent.key = k
 	ent.Image = pi
@@ -288,15 +273,76 @@ func (i *ImageStitcher) addWslog(filename string) {
 	}
 }
 
-func writeEventsBinary() {
+var errStop = errors.New("stop")
+
+// forEachSnapshot calls fn with every canvas snapshot with start <= ts <= end
+// in time order, where an end of 0 means no upper bound. With -frames the
+// snapshots come from a DeltaReader; otherwise the -datadir archives are
+// stitched together. fn may return errStop to end the walk early.
+func forEachSnapshot(start, end int64, fn func(n, total int, k SnapKey, im *image.Paletted) error) error {
+	err := walkSnapshots(start, end, fn)
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+func walkSnapshots(start, end int64, fn func(n, total int, k SnapKey, im *image.Paletted) error) error {
+	if *frames != "" {
+		dr, err := delta.MakeDeltaReader(prof, strings.Split(*frames, ",")...)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		it := dr.Frames(context.Background(), int(start), int(end))
+		for n := 0; it.Next(); n++ {
+			f := it.Frame()
+			if err := fn(n, it.Len(), GetKey(f.Entry.Canvas, int64(f.Entry.Ts)), f.Image); err != nil {
+				return err
+			}
+		}
+		return it.Err()
+	}
+
 	if *canvasDir == "" {
-		log.Fatal("-datadir is required")
+		return errors.New("-datadir or -frames is required")
 	}
 
 	i := NewImageStitcher(*canvasDir)
 	snaps := i.SortedSnaps()
-	fmt.Println("scanned", len(snaps), "images", snaps[:30], "...", snaps[len(snaps)-30:])
+	if len(snaps) > 60 {
+		fmt.Println("scanned", len(snaps), "images", snaps[:30], "...", snaps[len(snaps)-30:])
+	} else {
+		fmt.Println("scanned", len(snaps), "images", snaps)
+	}
+
+	for snapN, s := range snaps {
+		if s.Ts() < start {
+			continue
+		}
+		if end != 0 && s.Ts() > end {
+			break
+		}
+
+		t := time.Now()
+		si, err := i.GetImage(s)
+		elapsed := time.Since(t)
+		if err != nil {
+			log.Println("error decoding", i.snaps[s].name, err)
+			continue
+		}
+		if elapsed > 20*time.Millisecond {
+			log.Println("SLOW", s, i.snaps[s].full, elapsed)
+		}
+
+		if err := fn(snapN, len(snaps), s, si); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+func writeEventsBinary() {
 	wf, err := os.Create(*outFile)
 	if err != nil {
 		log.Fatal(err)
@@ -305,67 +351,48 @@ func writeEventsBinary() {
 	w := bufio.NewWriter(wf)
 	defer w.Flush()
 
-	// snaps is an ordered list of every canvas stored in delta format
-
 	w.Write([]byte("PIXELPAK"))
 
 	var buf [8]byte
 	var start_time uint64
 
-	firstImage, err := i.GetImage(snaps[0])
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	state := image.NewPaletted(image.Rect(0, 0, 3000, 2000), firstImage.Palette)
+	state := image.NewPaletted(prof.Bounds(), prof.Palette)
 	for i := 0; i < len(state.Pix); i++ {
-		state.Pix[i] = 32
+		state.Pix[i] = prof.Blank
 	}
+	width := prof.Width()
 
 	ev := 0
+	images := 0
 
-	for snapN, s := range snaps {
-		if s.Ts() < 1689820000000 {
-			continue
-		}
-		if *startTs != 0 && s.Ts() < *startTs {
-			continue
-		}
-		if *endTs != 0 && s.Ts() > *endTs {
-			break
-		}
+	// skip snapshots from before the event started
+	start := *startTs
+	if start < prof.Start {
+		start = prof.Start
+	}
 
+	err = forEachSnapshot(start, *endTs, func(snapN, total int, s SnapKey, si *image.Paletted) error {
 		if start_time == 0 {
 			start_time = uint64(s.Ts())
 			binary.LittleEndian.PutUint64(buf[:8], start_time)
 			w.Write(buf[:8])
 		}
 
-		start := time.Now()
-		si, err := i.GetImage(s)
-		elapsed := time.Since(start)
-		if err != nil {
-			log.Println("error decoding", i.snaps[s].name, err)
-			continue
-		}
-		if elapsed > 20*time.Millisecond {
-			log.Println("SLOW", s, i.snaps[s].full, elapsed)
-		}
-
-		if *maxImages > 0 && snapN >= *maxImages {
-			break
+		if *maxImages > 0 && images >= *maxImages {
+			return errStop
 		}
+		images++
 
 		binary.LittleEndian.PutUint32(buf[4:], uint32(uint64(s.Ts())-start_time))
 
 		sev := ev
-		for y := 0; y < 1000; y++ {
-			for x := 0; x < 1000; x++ {
+		for y := 0; y < prof.TileHeight; y++ {
+			for x := 0; x < prof.TileWidth; x++ {
 				ox := x + s.OffsetX()
 				oy := y + s.OffsetY()
 
-				wc := si.Pix[x+y*1000]
-				sc := state.Pix[ox+oy*3000]
+				wc := si.Pix[x+y*prof.TileWidth]
+				sc := state.Pix[ox+oy*width]
 
 				if wc != sc {
 					ev++
@@ -392,18 +419,15 @@ func writeEventsBinary() {
 
 		if snapN&0x7f == 0 {
 			sts := time.Unix(s.Ts()/1000, 0)
-			fmt.Printf("%d/%d %d %d %s\r", snapN, len(snaps), ev, s.Ts(), sts.Format("2006-01-02 15:04:05"))
+			fmt.Printf("%d/%d %d %d %s\r", snapN, total, ev, s.Ts(), sts.Format("2006-01-02 15:04:05"))
 		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
-var palette = []string{
-	"#6D001A", "#BE0039", "#FF4500", "#FFA800", "#FFD635", "#FFF8B8", "#00A368", "#00CC78",
-	"#7EED56", "#00756F", "#009EAA", "#00CCC0", "#2450A4", "#3690EA", "#51E9F4", "#493AC1",
-	"#6A5CFF", "#94B3FF", "#811E9F", "#B44AC0", "#E4ABFF", "#DE107F", "#FF3881", "#FF99AA",
-	"#6D482F", "#9C6926", "#FFB470", "#000000", "#515252", "#898D90", "#D4D7D9", "#FFFFFF",
-}
-
 func crunchEventsBinary() {
 	r, err := os.Open(*inFile)
 	if err != nil {
@@ -481,7 +505,8 @@ func crunchEventsBinary() {
 
 	writeHeader()
 
-	ocs := make([]uint8, 3000*2000)
+	width := prof.Width()
+	ocs := make([]uint8, width*prof.Height())
 	for i := range ocs {
 		ocs[i] = 31
 	}
@@ -506,7 +531,7 @@ func crunchEventsBinary() {
 		if oct >= 12 {
 			panic("bad octant")
 		}
-		ocs[x+y*3000] ^= uint8(new_color ^ old_color)
+		ocs[x+y*uint32(width)] ^= uint8(new_color ^ old_color)
 
 		if uint64(timeOffset) != curTs || oct != curOct {
 			writeChunk()
@@ -557,8 +582,9 @@ func crunchEventsColumn() {
 	w.Write([]byte("COLMPACK"))
 	w.Write(tstart[:8])
 
-	lastTs := make([]uint32, 3000*2000)
-	bufs := make([]bytes.Buffer, 3000*2000)
+	width := prof.Width()
+	lastTs := make([]uint32, width*prof.Height())
+	bufs := make([]bytes.Buffer, width*prof.Height())
 
 	for {
 		n, err := br.Read(buf[:8])
@@ -573,7 +599,7 @@ func crunchEventsColumn() {
 		buf[7] &= 127
 		timeOffset := binary.LittleEndian.Uint32(buf[4:])
 
-		o := x + y*3000
+		o := x + y*uint32(width)
 		pixTs := lastTs[o]
 		lastTs[o] = timeOffset
 
@@ -599,48 +625,30 @@ func crunchEventsColumn() {
 }
 
 func computeAverage() {
-	if *canvasDir == "" {
-		log.Fatal("-datadir is required")
-	}
+	counts := make([][33]int, prof.Width()*prof.Height())
 
-	i := NewImageStitcher(*canvasDir)
-	snaps := i.SortedSnaps()
-	fmt.Println("scanned", len(snaps), "images", snaps[:30], "...", snaps[len(snaps)-30:])
-
-	counts := make([][33]int, 3000*2000)
-
-	firstImage, err := i.GetImage(snaps[0])
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	state := image.NewPaletted(image.Rect(0, 0, 3000, 2000), firstImage.Palette)
+	state := image.NewPaletted(prof.Bounds(), prof.Palette)
 	for i := 0; i < len(state.Pix); i++ {
-		state.Pix[i] = 32
+		state.Pix[i] = prof.Blank
 	}
 
-	for snapN, s := range snaps {
-		if *startTs != 0 && s.Ts() < *startTs {
-			continue
-		}
-		if *endTs != 0 && s.Ts() > *endTs {
-			break
-		}
-		image, err := i.GetImage(s)
-		if err != nil {
-			log.Fatal(err)
-		}
+	width := prof.Width()
 
-		for y := 0; y < 1000; y++ {
-			for x := 0; x < 1000; x++ {
+	err := forEachSnapshot(*startTs, *endTs, func(snapN, total int, s SnapKey, image *image.Paletted) error {
+		for y := 0; y < prof.TileHeight; y++ {
+			for x := 0; x < prof.TileWidth; x++ {
 				ox := x + s.OffsetX()
 				oy := y + s.OffsetY()
-				counts[ox+oy*3000][image.Pix[x+y*1000]]++
+				counts[ox+oy*width][image.Pix[x+y*prof.TileWidth]]++
 			}
 		}
 
 		sts := time.Unix(s.Ts()/1000, 0)
-		fmt.Printf("%d/%d %d %s\r", snapN, len(snaps), s.Ts(), sts.Format("2006-01-02 15:04:05"))
+		fmt.Printf("%d/%d %d %s\r", snapN, total, s.Ts(), sts.Format("2006-01-02 15:04:05"))
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	for i, cs := range counts {
@@ -671,6 +679,12 @@ func computeAverage() {
 func main() {
 	flag.Parse()
 
+	var err error
+	prof, err = profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -19,7 +19,6 @@ import (
 	"encoding/binary"
 	"flag"
 	"image"
-	"image/color"
 	"io"
 	"log"
 	"os"
@@ -38,30 +37,27 @@ import (
 	"golang.org/x/mobile/event/mouse"
 	"golang.org/x/mobile/event/paint"
 	"golang.org/x/mobile/event/size"
+
+	"github.com/rmmh/rplace/profile"
 )
 
 var (
-	inFile = flag.String("in", "", "input binary events file name")
+	inFile      = flag.String("in", "", "input binary events file name")
+	profileName = flag.String("profile", "2022", "canvas profile: 2017, 2022 or 2023")
 )
 
-var palette = []color.Color{
-	color.RGBA{0x6d, 0x0, 0x1a, 0xff}, color.RGBA{0xbe, 0x0, 0x39, 0xff}, color.RGBA{0xff, 0x45, 0x0, 0xff}, color.RGBA{0xff, 0xa8, 0x0, 0xff},
-	color.RGBA{0xff, 0xd6, 0x35, 0xff}, color.RGBA{0xff, 0xf8, 0xb8, 0xff}, color.RGBA{0x0, 0xa3, 0x68, 0xff}, color.RGBA{0x0, 0xcc, 0x78, 0xff},
-	color.RGBA{0x7e, 0xed, 0x56, 0xff}, color.RGBA{0x0, 0x75, 0x6f, 0xff}, color.RGBA{0x0, 0x9e, 0xaa, 0xff}, color.RGBA{0x0, 0xcc, 0xc0, 0xff},
-	color.RGBA{0x24, 0x50, 0xa4, 0xff}, color.RGBA{0x36, 0x90, 0xea, 0xff}, color.RGBA{0x51, 0xe9, 0xf4, 0xff}, color.RGBA{0x49, 0x3a, 0xc1, 0xff},
-	color.RGBA{0x6a, 0x5c, 0xff, 0xff}, color.RGBA{0x94, 0xb3, 0xff, 0xff}, color.RGBA{0x81, 0x1e, 0x9f, 0xff}, color.RGBA{0xb4, 0x4a, 0xc0, 0xff},
-	color.RGBA{0xe4, 0xab, 0xff, 0xff}, color.RGBA{0xde, 0x10, 0x7f, 0xff}, color.RGBA{0xff, 0x38, 0x81, 0xff}, color.RGBA{0xff, 0x99, 0xaa, 0xff},
-	color.RGBA{0x6d, 0x48, 0x2f, 0xff}, color.RGBA{0x9c, 0x69, 0x26, 0xff}, color.RGBA{0xff, 0xb4, 0x70, 0xff}, color.RGBA{0x0, 0x0, 0x0, 0xff},
-	color.RGBA{0x51, 0x52, 0x52, 0xff}, color.RGBA{0x89, 0x8d, 0x90, 0xff}, color.RGBA{0xd4, 0xd7, 0xd9, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff},
-}
-
 func main() {
 	flag.Parse()
 	log.SetFlags(0)
+	prof, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
 	driver.Main(func(s screen.Screen) {
 		// TODO: view multiple images.
+		// events number colors from 0, skipping the transparent entry
 		var src image.Image
-		src = image.NewPaletted(image.Rect(0, 0, 2000, 2000), palette)
+		src = image.NewPaletted(prof.Bounds(), prof.Palette[1:])
 
 		wim := widget.NewImage(src, src.Bounds())
 		root := widget.NewSheet(wim)
@@ -78,7 +74,7 @@ func main() {
 			im := src.(*image.Paletted)
 
 			for i := 0; i < len(im.Pix); i++ {
-				im.Pix[i] = 31
+				im.Pix[i] = prof.Blank - 1
 			}
 
 			r, err := os.Open(*inFile)
@@ -0,0 +1,88 @@
+// render how often each pixel changed over a time window from a COLMPACK
+// file, as a log scaled PNG, and list the regions that changed most.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"os"
+
+	"github.com/rmmh/rplace/columnar"
+	"github.com/rmmh/rplace/profile"
+)
+
+var (
+	column      = flag.String("column", "", "COLMPACK file to read")
+	profileName = flag.String("profile", profile.Default, "canvas profile: 2017, 2022 or 2023")
+	out         = flag.String("o", "heatmap.png", "PNG file to write, or empty for none")
+	from        = flag.Int64("from", 0, "count changes from this time, in milliseconds")
+	to          = flag.Int64("to", 0, "count changes up to this time, in milliseconds (0 for the end)")
+	region      = flag.String("region", "", "x,y,w,h part of the canvas to render (default all of it)")
+	scale       = flag.Int("scale", 1, "magnify each pixel into a scale x scale block")
+	downscale   = flag.Int("downscale", 1, "sum the changes of each downscale x downscale block")
+	max         = flag.Uint("max", 0, "change count shown brightest (0 for the most changed pixel)")
+	top         = flag.Int("top", 0, "print this many regions that changed most as JSON")
+	cell        = flag.Int("cell", 50, "size of the regions listed by -top")
+)
+
+func main() {
+	flag.Parse()
+
+	p, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *column == "" {
+		log.Fatal("-column is required")
+	}
+	if *scale < 1 || *downscale < 1 || *cell < 1 || (*scale > 1 && *downscale > 1) {
+		log.Fatal("-scale, -downscale and -cell must be positive, and only one of -scale and -downscale given")
+	}
+
+	r := p.Bounds()
+	if *region != "" {
+		var x, y, w, h int
+		if _, err := fmt.Sscanf(*region, "%d,%d,%d,%d", &x, &y, &w, &h); err != nil {
+			log.Fatal("bad -region: ", err)
+		}
+		r = image.Rect(x, y, x+w, y+h).Intersect(r)
+	}
+	if *to == 0 {
+		*to = p.End
+	}
+
+	col, err := columnar.MakeColumnarReader(*column, p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h := col.Heatmap(*from, *to, r)
+	log.Printf("%d changes, at most %d to a pixel", h.Total, h.Max)
+
+	if *top > 0 {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(h.Hottest(*cell, *top))
+	}
+
+	if *out == "" {
+		return
+	}
+	if *downscale > 1 {
+		h = h.Downscale(*downscale)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := png.Encode(f, h.Image(uint32(*max), *scale)); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
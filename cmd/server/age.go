@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/columnar"
+	"github.com/rmmh/rplace/delta"
+)
+
+var grayPalette = func() color.Palette {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.Gray{uint8(i)}
+	}
+	return pal
+}()
+
+// ages returns how many seconds each pixel of region has held its color at
+// ts, in row order. Pixels unchanged since the start count from the start.
+func (s *server) ages(ctx context.Context, ts int64, region image.Rectangle) ([]uint32, error) {
+	var last []int64
+	if s.col != nil {
+		last = s.col.LastChanged(ts, region)
+	} else {
+		var err error
+		last, err = s.dr.LastChanged(ctx, int(ts), region)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ages := make([]uint32, len(last))
+	for i, t := range last {
+		if t == 0 {
+			t = s.p.Start
+		}
+		if t < ts {
+			ages[i] = uint32((ts - t) / 1000)
+		}
+	}
+	return ages, nil
+}
+
+// ageHandler serves how long each pixel has held its color at a moment, as
+// little endian uint32 seconds in row order for the bin format, or for png as
+// an image where newer colors are brighter, on a log scale up to the max
+// query parameter, in seconds, or the time since the start. color=gray draws
+// it in grays instead of the heatmap colors. The X-Crop-* headers give the
+// part of the canvas covered.
+func (s *server) ageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ts, _ := strconv.ParseInt(vars["ts"], 10, 64)
+	format := vars["format"]
+	vals := r.URL.Query()
+
+	region, err := s.regionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	max := (ts - s.p.Start) / 1000
+	if max < 1 {
+		max = 1
+	}
+	if q := vals.Get("max"); q != "" {
+		if max, err = strconv.ParseInt(q, 10, 32); err != nil || max <= 0 {
+			http.Error(w, "bad max", 400)
+			return
+		}
+	}
+	pal := columnar.HeatmapPalette
+	switch vals.Get("color") {
+	case "", "heatmap":
+	case "gray":
+		pal = grayPalette
+	default:
+		http.Error(w, "color must be heatmap or gray", 400)
+		return
+	}
+
+	// ages depend on the time itself as well as the changes before it
+	parts := []string{s.p.Name, format, fmt.Sprint(ts, region, max, vals.Get("color"))}
+	if s.col != nil {
+		parts = append(parts, s.col.ID)
+	} else {
+		for _, ci := range s.dr.CompositeInfo(int(ts), delta.CompositeOptions{MaxStaleness: -1, Region: region}) {
+			parts = append(parts, ci.Name)
+		}
+	}
+	key := s.renderKey("age", parts...)
+	if checkETag(w, r, key) {
+		return
+	}
+
+	// without columnar data every frame up to ts is walked, which can outlast
+	// the client and its write deadline, so stop with them
+	ctx := r.Context()
+	if t := s.timeout("age"); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	data, err := s.rc.Get(key, func() ([]byte, error) {
+		ages, err := s.ages(ctx, ts, region)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if format == "bin" {
+			err = binary.Write(&buf, binary.LittleEndian, ages)
+			return buf.Bytes(), err
+		}
+		im := image.NewPaletted(image.Rect(0, 0, region.Dx(), region.Dy()), pal)
+		lmax := math.Log1p(float64(max))
+		for i, a := range ages {
+			if int64(a) < max {
+				im.Pix[i] = 255 - uint8(math.Log1p(float64(a))/lmax*255)
+			}
+		}
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		err = enc.Encode(&buf, im)
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	setETag(w, key)
+	w.Header().Set("x-crop-x", strconv.Itoa(region.Min.X))
+	w.Header().Set("x-crop-y", strconv.Itoa(region.Min.Y))
+	w.Header().Set("x-crop-width", strconv.Itoa(region.Dx()))
+	w.Header().Set("x-crop-height", strconv.Itoa(region.Dy()))
+	if format == "bin" {
+		w.Header().Set("content-type", "application/octet-stream")
+	} else {
+		w.Header().Set("content-type", "image/png")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rmmh/rplace/columnar"
+	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/palette"
+	"github.com/rmmh/rplace/profile"
+)
+
+func TestAgesSourcesAgree(t *testing.T) {
+	p := &profile.Profile{
+		Name:     "test",
+		Canvases: 1, TileWidth: 3, TileHeight: 1,
+		Offsets: []image.Point{{0, 0}},
+		Pal:     palette.Palette2017,
+		Palette: palette.Palette2017.Colors,
+		Blank:   1,
+		Start:   500,
+		End:     5000,
+	}
+	// pixel 0 is placed again in its color, pixel 1 changes color, and
+	// pixel 2 is placed in the blank color; colors are API indexes
+	type change struct {
+		ts    int64
+		color uint8
+	}
+	hists := [][]change{
+		{{1000, 3}, {2000, 3}},
+		{{1000, 3}, {2000, 5}},
+		{{2000, 0}},
+	}
+
+	dir := t.TempDir()
+	var lens, data []byte
+	for _, h := range hists {
+		before, last := len(data), int64(500)
+		for _, c := range h {
+			data = binary.AppendUvarint(data, uint64(c.ts-last)<<5|uint64(c.color))
+			last = c.ts
+		}
+		lens = binary.AppendUvarint(lens, uint64(len(data)-before))
+	}
+	b := binary.LittleEndian.AppendUint64([]byte("COLMPACK"), 500)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(b)+4+len(lens)))
+	colPath := filepath.Join(dir, "col.bin")
+	if err := os.WriteFile(colPath, append(append(b, lens...), data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	col, err := columnar.MakeColumnarReader(colPath, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+
+	// a keyframe of the canvas at each change
+	frames := filepath.Join(dir, "frames")
+	os.Mkdir(frames, 0755)
+	for _, ts := range []int64{1000, 2000, 3000} {
+		im := image.NewPaletted(image.Rect(0, 0, 3, 1), p.Palette)
+		for i, h := range hists {
+			im.Pix[i] = p.Blank
+			for _, c := range h {
+				if c.ts <= ts {
+					im.Pix[i] = c.color + 1
+				}
+			}
+		}
+		f, err := os.Create(filepath.Join(frames, fmt.Sprintf("%d-0.png", ts)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		png.Encode(f, im)
+		f.Close()
+	}
+	dr, err := delta.MakeDeltaReader(p, frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dr.Close()
+
+	want := []uint32{2, 1, 2}
+	region := image.Rect(0, 0, 3, 1)
+	for _, s := range []*server{{p: p, col: col}, {p: p, dr: dr}} {
+		ages, err := s.ages(context.Background(), 3000, region)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want {
+			if ages[i] != want[i] {
+				t.Errorf("columnar %v: ages %v, want %v", s.col != nil, ages, want)
+				break
+			}
+		}
+	}
+}
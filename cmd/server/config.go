@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/delta"
+)
+
+// duration is a time.Duration read from JSON in Go's syntax, such as "5m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// gifLimits bound the timelapses the server renders.
+type gifLimits struct {
+	MaxFrames int `json:"maxFrames"`
+	// MaxPixels bounds the area around the center pixel, and grows with the
+	// square of the scale.
+	MaxPixels   int      `json:"maxPixels"`
+	MaxScale    int      `json:"maxScale"`
+	MinInterval duration `json:"minInterval"`
+}
+
+func (l gifLimits) check() error {
+	if l.MaxFrames < 1 || l.MaxPixels < 1 || l.MaxScale < 1 || l.MinInterval < duration(time.Millisecond) {
+		return fmt.Errorf("limits must be positive")
+	}
+	return nil
+}
+
+// config is the server's configuration, read from the -config file or, if
+// there is none, from flags.
+type config struct {
+	// Listen holds the addresses to serve on, as host:port or unix:path.
+	Listen      []string `json:"listen"`
+	ReadTimeout duration `json:"readTimeout"`
+	// Timeouts bounds how long responses may take to write, by route name
+	// ("full", "gif", "replay", ...), with "default" for any other route. A
+	// timeout of 0 means no limit.
+	Timeouts map[string]duration `json:"timeouts"`
+	// ShutdownTimeout is how long to wait for requests to finish on SIGTERM.
+	ShutdownTimeout duration `json:"shutdownTimeout"`
+
+	// FrameCacheMB is the size of each dataset's decoded frame cache.
+	FrameCacheMB  int    `json:"frameCacheMB"`
+	RenderCache   string `json:"renderCache"`
+	RenderCacheMB int    `json:"renderCacheMB"`
+
+	Gif gifLimits `json:"gif"`
+	// Jobs configures asynchronous renders, and only changes on restart.
+	Jobs     jobSettings `json:"jobs"`
+	Datasets []dataset   `json:"datasets"`
+}
+
+func defaultConfig() config {
+	return config{
+		Listen:      []string{"127.0.0.1:9999"},
+		ReadTimeout: duration(10 * time.Second),
+		Timeouts: map[string]duration{
+			"default":   duration(10 * time.Second),
+			"gif":       duration(5 * time.Minute),
+			"jobresult": duration(5 * time.Minute),
+			"replay":    0,
+		},
+		ShutdownTimeout: duration(30 * time.Second),
+		FrameCacheMB:    delta.DefaultCacheBytes >> 20,
+		RenderCacheMB:   1024,
+		Gif: gifLimits{
+			MaxFrames:   20000,
+			MaxPixels:   600 * 600,
+			MaxScale:    4,
+			MinInterval: duration(time.Second),
+		},
+		Jobs: jobSettings{
+			Workers:   2,
+			Queue:     64,
+			PerClient: 2,
+			Expiry:    duration(time.Hour),
+			Limits: gifLimits{
+				MaxFrames:   200000,
+				MaxPixels:   2000 * 2000,
+				MaxScale:    4,
+				MinInterval: duration(time.Second),
+			},
+		},
+	}
+}
+
+// readConfig reads a JSON config file. Settings it leaves out keep their
+// defaults, and timeouts it gives are added to the default ones.
+func readConfig(path string) (config, error) {
+	c := defaultConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	timeouts := c.Timeouts
+	c.Timeouts = nil
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	for k, v := range c.Timeouts {
+		timeouts[k] = v
+	}
+	c.Timeouts = timeouts
+	return c, c.check()
+}
+
+func (c *config) check() error {
+	if len(c.Listen) == 0 {
+		return fmt.Errorf("no listen addresses")
+	}
+	if len(c.Datasets) == 0 {
+		return fmt.Errorf("no datasets")
+	}
+	names := map[string]bool{}
+	for _, d := range c.Datasets {
+		if d.Name == "" && len(c.Datasets) > 1 {
+			return fmt.Errorf("every dataset needs a name when there's more than one")
+		}
+		if d.Name != "" {
+			if err := checkDatasetName(d.Name); err != nil {
+				return err
+			}
+		}
+		if names[d.Name] {
+			return fmt.Errorf("dataset %s given twice", d.Name)
+		}
+		names[d.Name] = true
+	}
+	if err := c.Gif.check(); err != nil {
+		return fmt.Errorf("gif %w", err)
+	}
+	j := c.Jobs
+	if j.Dir == "" {
+		return nil
+	}
+	if j.Workers < 1 || j.Queue < 1 || j.PerClient < 1 || j.Expiry < duration(time.Second) {
+		return fmt.Errorf("job settings must be positive")
+	}
+	if err := j.Limits.check(); err != nil {
+		return fmt.Errorf("job %w", err)
+	}
+	return nil
+}
+
+// timeout returns the write timeout of a route.
+func (c *config) timeout(route string) time.Duration {
+	if t, ok := c.Timeouts[route]; ok {
+		return time.Duration(t)
+	}
+	return time.Duration(c.Timeouts["default"])
+}
+
+// listen opens a listener for a host:port or unix:path address, replacing
+// any stale socket file. Any other file at the path is left alone, and
+// listening fails.
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// app holds the loaded datasets and the router serving them, which is
+// replaced wholesale when the config is reloaded.
+type app struct {
+	cfg     config
+	rc      *renderCache
+	jobs    *jobManager
+	servers map[dataset]*server
+	handler http.Handler
+
+	mu sync.Mutex
+	// active counts the requests being served
+	active  int
+	retired bool
+}
+
+// serve handles a request, returning false without handling it if a has
+// been retired.
+func (a *app) serve(w http.ResponseWriter, r *http.Request) bool {
+	a.mu.Lock()
+	if a.retired {
+		a.mu.Unlock()
+		return false
+	}
+	a.active++
+	a.mu.Unlock()
+	defer a.done()
+	// instrumented routes replace this with their own timeout
+	if t := a.cfg.timeout("default"); t > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(t))
+	}
+	a.handler.ServeHTTP(w, r)
+	return true
+}
+
+func (a *app) done() {
+	a.mu.Lock()
+	a.active--
+	last := a.retired && a.active == 0
+	a.mu.Unlock()
+	if last {
+		a.release()
+	}
+}
+
+// retire stops a serving new requests, once it has been replaced, and
+// releases its datasets when the requests it's serving finish. Datasets no
+// later app or job uses are closed.
+func (a *app) retire() {
+	a.mu.Lock()
+	a.retired = true
+	last := a.active == 0
+	a.mu.Unlock()
+	if last {
+		a.release()
+	}
+}
+
+func (a *app) release() {
+	for _, s := range a.servers {
+		s.files.release()
+	}
+}
+
+// build loads the datasets of cfg, reusing those of prev whose settings are
+// unchanged, and routes requests to them.
+func build(cfg config, prev *app) (*app, error) {
+	a := &app{cfg: cfg, servers: make(map[dataset]*server)}
+	if prev != nil && prev.cfg.RenderCache == cfg.RenderCache && prev.cfg.RenderCacheMB == cfg.RenderCacheMB {
+		a.rc = prev.rc
+	} else {
+		var err error
+		if a.rc, err = newRenderCache(cfg.RenderCache, int64(cfg.RenderCacheMB)<<20); err != nil {
+			return nil, err
+		}
+	}
+
+	if prev != nil {
+		a.jobs = prev.jobs
+	} else if cfg.Jobs.Dir != "" {
+		var err error
+		if a.jobs, err = newJobManager(cfg.Jobs); err != nil {
+			return nil, err
+		}
+	}
+
+	r := mux.NewRouter()
+	var servers []*server
+	for _, d := range cfg.Datasets {
+		var s *server
+		if old := prev.server(d); old != nil {
+			// requests in flight keep using the old copy
+			sc := *old
+			s = &sc
+			s.dr.SetCacheLimit(int64(cfg.FrameCacheMB) << 20)
+		} else {
+			var err error
+			if s, err = d.load(int64(cfg.FrameCacheMB) << 20); err != nil {
+				a.release()
+				return nil, fmt.Errorf("dataset %s: %w", d.Name, err)
+			}
+		}
+		s.files.acquire()
+		s.rc = a.rc
+		s.gif = cfg.Gif
+		s.timeout = cfg.timeout
+		s.jobs = a.jobs
+		s.routes(r)
+		a.servers[d] = s
+		servers = append(servers, s)
+	}
+	r.HandleFunc("/metrics", metricsHandler(servers))
+	r.HandleFunc("/debug/stats", statsHandler(servers))
+	if cfg.Datasets[0].Name != "" {
+		r.HandleFunc("/", rootHandler(cfg.Datasets))
+	}
+	a.handler = r
+	return a, nil
+}
+
+func (a *app) server(d dataset) *server {
+	if a == nil {
+		return nil
+	}
+	return a.servers[d]
+}
+
+// stopping is cancelled when the server starts shutting down, to end
+// streams that would otherwise never finish.
+var stopping, stop = context.WithCancel(context.Background())
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfig(t *testing.T) {
+	c, err := readConfig(writeConfig(t, `{
+		"timeouts": {"gif": "1m", "tiles": "2s"},
+		"gif": {"maxFrames": 10, "maxPixels": 100, "maxScale": 2, "minInterval": "1s"},
+		"datasets": [{"profile": "2017"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// timeouts given are added to the defaults
+	for route, want := range map[string]time.Duration{
+		"gif":     time.Minute,
+		"tiles":   2 * time.Second,
+		"replay":  0,
+		"default": 10 * time.Second,
+		"full":    10 * time.Second,
+	} {
+		if got := c.timeout(route); got != want {
+			t.Errorf("timeout(%s) = %v, want %v", route, got, want)
+		}
+	}
+	if c.Gif.MaxFrames != 10 || c.RenderCacheMB != 1024 || len(c.Listen) != 1 {
+		t.Errorf("read %+v", c)
+	}
+	if _, err := readConfig(writeConfig(t, `{"datasets": [{"profile": "2017"}], "cache": 5}`)); err == nil {
+		t.Error("read a config with an unknown field")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(c *config)
+	}{
+		{"no listen addresses", func(c *config) { c.Listen = nil }},
+		{"no datasets", func(c *config) { c.Datasets = nil }},
+		{"unnamed datasets", func(c *config) { c.Datasets = append(c.Datasets, dataset{Name: "b"}) }},
+		{"reserved name", func(c *config) { c.Datasets[0].Name = "metrics" }},
+		{"route name", func(c *config) { c.Datasets[0].Name = "jobs" }},
+		{"dot name", func(c *config) { c.Datasets[0].Name = ".." }},
+		{"name with a slash", func(c *config) { c.Datasets[0].Name = "a/b" }},
+		{"duplicate names", func(c *config) { c.Datasets = []dataset{{Name: "a"}, {Name: "a"}} }},
+		{"no gif frames", func(c *config) { c.Gif.MaxFrames = 0 }},
+		{"short gif interval", func(c *config) { c.Gif.MinInterval = 0 }},
+		{"no job workers", func(c *config) { c.Jobs.Dir, c.Jobs.Workers = "jobs", 0 }},
+		{"no job frames", func(c *config) { c.Jobs.Dir, c.Jobs.Limits.MaxFrames = "jobs", 0 }},
+	} {
+		c := defaultConfig()
+		c.Datasets = []dataset{{Profile: "2017"}}
+		if err := c.check(); err != nil {
+			t.Fatalf("default config: %v", err)
+		}
+		tc.edit(&c)
+		if err := c.check(); err == nil {
+			t.Errorf("%s: passed the check", tc.name)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	// a socket left by a previous run is replaced
+	sock := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip("no unix sockets:", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = listen("unix:" + sock); err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	l.Close()
+
+	// anything else is left alone
+	file := filepath.Join(dir, "data")
+	os.WriteFile(file, []byte("keep"), 0644)
+	if l, err := listen("unix:" + file); err == nil {
+		l.Close()
+		t.Error("listened over a regular file")
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "keep" {
+		t.Errorf("regular file now %q, %v", b, err)
+	}
+}
+
+func TestRetire(t *testing.T) {
+	closed := 0
+	s := &server{files: &openFiles{close: func() error { closed++; return nil }}}
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release })
+
+	// a reload keeps the dataset, and a second drops it
+	var apps []*app
+	for i := 0; i < 2; i++ {
+		s.files.acquire()
+		apps = append(apps, &app{servers: map[dataset]*server{{Name: "a"}: s}, handler: handler})
+	}
+
+	served := make(chan bool)
+	go func() {
+		served <- apps[0].serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	for {
+		apps[0].mu.Lock()
+		active := apps[0].active
+		apps[0].mu.Unlock()
+		if active == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	apps[0].retire()
+	if apps[0].serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) {
+		t.Error("a retired app served a request")
+	}
+	apps[1].retire()
+	if closed != 0 {
+		t.Fatal("closed the dataset while a request was using it")
+	}
+	close(release)
+	if !<-served {
+		t.Error("the request wasn't served")
+	}
+	if closed != 1 {
+		t.Errorf("closed the dataset %d times once the request finished", closed)
+	}
+
+	// jobs hold on to datasets too
+	closed = 0
+	s.files.acquire()
+	s.files.acquire()
+	s.files.release()
+	if closed != 0 {
+		t.Fatal("closed the dataset while a job was using it")
+	}
+	s.files.release()
+	if closed != 1 {
+		t.Errorf("closed the dataset %d times once the job finished", closed)
+	}
+}
+
+func TestRetireUnused(t *testing.T) {
+	closed := false
+	s := &server{files: &openFiles{close: func() error { closed = true; return nil }}}
+	s.files.acquire()
+	a := &app{servers: map[dataset]*server{{Name: "a"}: s}}
+	a.retire()
+	if !closed {
+		t.Error("retiring an idle app didn't close its dataset")
+	}
+}
+
+func TestDatasetFlags(t *testing.T) {
+	var f datasetFlags
+	if err := f.Set("a:profile=2022;start=5"); err != nil || len(f) != 1 || f[0].Start != 5 || f[0].Profile != "2022" {
+		t.Fatalf("Set = %v, giving %+v", err, f)
+	}
+	for _, spec := range []string{"a:", ":profile=2022", "metrics:", "jobs:", "gif:", "a/b:", "b:start=x", "b:nope=1"} {
+		if err := f.Set(spec); err == nil {
+			t.Errorf("Set(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestDefaultWriteTimeout(t *testing.T) {
+	written := make(chan error, 1)
+	a := &app{
+		cfg: config{Timeouts: map[string]duration{"default": duration(50 * time.Millisecond)}},
+		// an uninstrumented route, too slow for the default timeout
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			_, err := w.Write(make([]byte, 1<<20))
+			written <- err
+		}),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { a.serve(w, r) }))
+	defer ts.Close()
+	if resp, err := http.Get(ts.URL); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if err := <-written; err == nil {
+		t.Error("wrote past the default write deadline")
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/columnar"
+	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/profile"
+)
+
+// dataset is one event's data, served under /Name/, or at the root when it's
+// the only one and has no name. Lists of files are comma-separated and may
+// hold globs.
+type dataset struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile"`
+	DataDir string `json:"datadir"`
+	// Frames replaces the canvas zips in DataDir.
+	Frames string `json:"frames"`
+	Column string `json:"column"`
+	Events string `json:"events"`
+	// Start and End, if set, narrow the profile's time range.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Prefix is the path the dataset is served under.
+func (d dataset) Prefix() string {
+	if d.Name == "" {
+		return "/"
+	}
+	return "/" + d.Name + "/"
+}
+
+// reservedNames are the first path segments of the root router's routes and
+// of the dataset routes, which a dataset served under its name would shadow
+// or be confused with.
+var reservedNames = map[string]bool{
+	"metrics": true, "debug": true,
+	"full": true, "delta": true, "tiles": true, "diff": true, "age": true, "gif": true,
+	"heatmap": true, "pixel": true, "pixels": true, "jobs": true, "replay": true,
+}
+
+// checkDatasetName checks that a dataset can be served under name.
+func checkDatasetName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/?#") || reservedNames[name] {
+		return fmt.Errorf("bad dataset name %q", name)
+	}
+	return nil
+}
+
+// datasetFlags collects repeated -dataset flags.
+type datasetFlags []dataset
+
+func (f *datasetFlags) String() string {
+	var names []string
+	for _, d := range *f {
+		names = append(names, d.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// Set parses a dataset given as name:key=value;key=value..., with keys
+// profile, datadir, frames, column, events, start and end.
+func (f *datasetFlags) Set(spec string) error {
+	name, opts, _ := strings.Cut(spec, ":")
+	if err := checkDatasetName(name); err != nil {
+		return err
+	}
+	d := dataset{Name: name, Profile: profile.Default, DataDir: "."}
+	for _, opt := range strings.Split(opts, ";") {
+		if opt == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok {
+			return fmt.Errorf("dataset %s: expected key=value, got %q", name, opt)
+		}
+		var err error
+		switch k {
+		case "profile":
+			d.Profile = v
+		case "datadir":
+			d.DataDir = v
+		case "frames":
+			d.Frames = v
+		case "column":
+			d.Column = v
+		case "events":
+			d.Events = v
+		case "start":
+			d.Start, err = strconv.ParseInt(v, 10, 64)
+		case "end":
+			d.End, err = strconv.ParseInt(v, 10, 64)
+		default:
+			return fmt.Errorf("dataset %s: unknown key %q", name, k)
+		}
+		if err != nil {
+			return fmt.Errorf("dataset %s: bad %s: %w", name, k, err)
+		}
+	}
+	for _, o := range *f {
+		if o.Name == name {
+			return fmt.Errorf("dataset %s given twice", name)
+		}
+	}
+	*f = append(*f, d)
+	return nil
+}
+
+// expandGlobs expands a comma-separated list of globs, keeping each glob's
+// matches sorted.
+func expandGlobs(list string) ([]string, error) {
+	var paths []string
+	for _, pat := range strings.Split(list, ",") {
+		m, err := filepath.Glob(pat)
+		if err != nil {
+			return nil, err
+		}
+		if len(m) == 0 {
+			return nil, fmt.Errorf("no files match %s", pat)
+		}
+		sort.Strings(m)
+		paths = append(paths, m...)
+	}
+	return paths, nil
+}
+
+// load opens a dataset's frames, columnar file and event files.
+func (d *dataset) load(cacheBytes int64) (*server, error) {
+	var patterns []string
+	if d.Frames != "" {
+		patterns = strings.Split(d.Frames, ",")
+	} else {
+		patterns = []string{filepath.Join(d.DataDir, "canvas_full.zip")}
+		dname := filepath.Join(d.DataDir, "canvas_delta.zip")
+		if _, err := os.Stat(dname); err == nil {
+			patterns = append(patterns, dname)
+		}
+		patterns = append(patterns, filepath.Join(d.DataDir, "canvas_ticks*.zip"))
+	}
+
+	log.Println(d.Name, patterns)
+
+	p, err := profile.Lookup(d.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if d.Start != 0 || d.End != 0 {
+		pc := *p
+		if d.Start != 0 {
+			pc.Start = d.Start
+		}
+		if d.End != 0 {
+			pc.End = d.End
+		}
+		p = &pc
+	}
+
+	dr, err := delta.MakeDeltaReader(p, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	dr.SetCacheLimit(cacheBytes)
+
+	s := &server{name: d.Name, prefix: d.Prefix(), p: p, dr: dr}
+	s.files = &openFiles{close: s.close}
+	if d.Column != "" {
+		if s.col, err = columnar.MakeColumnarReader(d.Column, p); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	if d.Events != "" {
+		if s.events, err = expandGlobs(d.Events); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// close closes the dataset's frame stores and columnar file.
+func (s *server) close() error {
+	err := s.dr.Close()
+	if s.col != nil {
+		if cerr := s.col.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// openFiles counts the users of a dataset's open files, which are shared by
+// the copies of its server in successive configs, and closes them once there
+// are none. Each app holding the server is a user, as is each job rendering
+// from it.
+type openFiles struct {
+	mu    sync.Mutex
+	users int
+	close func() error
+}
+
+func (f *openFiles) acquire() {
+	f.mu.Lock()
+	f.users++
+	f.mu.Unlock()
+}
+
+func (f *openFiles) release() {
+	f.mu.Lock()
+	f.users--
+	last := f.users == 0
+	f.mu.Unlock()
+	if last {
+		if err := f.close(); err != nil {
+			log.Println("closing dataset:", err)
+		}
+	}
+}
+
+// routes registers the dataset's handlers under its prefix.
+func (s *server) routes(root *mux.Router) {
+	r := root
+	if s.prefix != "/" {
+		// pages link relative to the prefix, so it needs the slash
+		root.Handle(strings.TrimSuffix(s.prefix, "/"), http.RedirectHandler(s.prefix, http.StatusMovedPermanently))
+		r = root.PathPrefix(strings.TrimSuffix(s.prefix, "/")).Subrouter()
+	}
+
+	r.HandleFunc("/", s.instrument("index", s.indexHandler))
+	r.HandleFunc("/full/{ts:[0-9]+}.png", s.instrument("full", s.fullHandler))
+	r.HandleFunc("/delta/{quad:[0-9]+}/{ts:[0-9]+}.png", s.instrument("delta", s.deltaHandler))
+	r.HandleFunc("/tiles/{ts:[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", s.instrument("tiles", s.tileHandler))
+	r.HandleFunc("/diff/{ts1:[0-9]+}/{ts2:[0-9]+}.{format:png|json}", s.instrument("diff", s.diffHandler))
+	r.HandleFunc("/age/{ts:[0-9]+}.{format:png|bin}", s.instrument("age", s.ageHandler))
+	if s.col != nil {
+		r.HandleFunc("/gif/{x:[0-9]+}_{y:[0-9]+}-{w:[0-9]+}x{h:[0-9]+}.gif", s.instrument("gif", s.gifHandler))
+		r.HandleFunc("/heatmap.{format:png|json}", s.instrument("heatmap", s.heatmapHandler))
+		r.HandleFunc("/pixel/{x:[0-9]+}_{y:[0-9]+}.{format:json|csv}", s.instrument("pixel", s.pixelHandler))
+		r.HandleFunc("/pixels/{x:[0-9]+}_{y:[0-9]+}-{w:[0-9]+}x{h:[0-9]+}.{format:json|csv}", s.instrument("pixels", s.pixelsHandler))
+	}
+
+	if s.jobs != nil {
+		r.HandleFunc("/jobs", s.instrument("jobs", s.jobsHandler)).Methods("POST")
+		r.HandleFunc("/jobs/{id:[0-9a-f]+}", s.instrument("job", s.jobHandler))
+		r.HandleFunc("/jobs/{id:[0-9a-f]+}/result", s.instrument("jobresult", s.jobResultHandler))
+	}
+
+	if len(s.events) > 0 {
+		r.HandleFunc("/replay", s.instrument("replay", s.replayHandler))
+	}
+}
+
+var rootTmpl = template.Must(template.New("root").Parse(`
+<html>
+<head>
+<title>r/Place Timelines</title>
+</head>
+<body style="background-color:black;color:white;">
+<ul>
+{{range .}}<li><a href="{{.Prefix}}" style="color:white">{{.Name}}</a> ({{.Profile}})</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// rootHandler lists the datasets when there's more than one.
+func rootHandler(ds []dataset) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := rootTmpl.Execute(w, ds); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	}
+}
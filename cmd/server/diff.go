@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/delta"
+)
+
+// maskPalette colors diff masks: changed pixels are opaque red.
+var maskPalette = color.Palette{color.RGBA{}, color.RGBA{0xff, 0, 0, 0xff}}
+
+type diffRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+func makeDiffRect(r image.Rectangle) *diffRect {
+	if r.Empty() {
+		return nil
+	}
+	return &diffRect{r.Min.X, r.Min.Y, r.Dx(), r.Dy()}
+}
+
+type diffCanvas struct {
+	Canvas  int       `json:"canvas"`
+	Changed int       `json:"changed"`
+	Bounds  *diffRect `json:"bounds"`
+}
+
+type diffSummary struct {
+	Palette string `json:"palette"`
+	// From and To are the requested times, and FromFrame and ToFrame the
+	// newest frames used for each.
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	FromFrame int       `json:"fromFrame"`
+	ToFrame   int       `json:"toFrame"`
+	Region    *diffRect `json:"region"`
+	Changed   int       `json:"changed"`
+	Bounds    *diffRect `json:"bounds"`
+	// Canvases has an entry per canvas compared. Missing lists those left
+	// out because either time had no recent frame for them.
+	Canvases []diffCanvas `json:"canvases"`
+	Missing  []int        `json:"missing"`
+}
+
+// diff compares the canvas at two times. The image holds the newer color of
+// each changed pixel, or, with mask set, is a highlight mask of them.
+func (s *server) diff(ts1, ts2 int, region image.Rectangle, mask bool) (*image.Paletted, *diffSummary, error) {
+	opts := delta.CompositeOptions{Region: region}
+	c1, err := s.dr.Composite(ts1, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := s.dr.Composite(ts2, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	region = c2.Image.Rect
+
+	pal := s.p.Palette
+	if mask {
+		pal = maskPalette
+	}
+	out := image.NewPaletted(region, pal)
+	sum := &diffSummary{
+		Palette:   s.p.Pal.Name,
+		From:      ts1,
+		To:        ts2,
+		FromFrame: c1.Latest,
+		ToFrame:   c2.Latest,
+		Region:    makeDiffRect(region),
+		Canvases:  []diffCanvas{},
+		Missing:   []int{},
+	}
+	var bounds image.Rectangle
+	for i, ci := range c2.Canvases {
+		if ci.Missing || c1.Canvases[i].Missing {
+			sum.Missing = append(sum.Missing, ci.Canvas)
+			continue
+		}
+		dc := diffCanvas{Canvas: ci.Canvas}
+		var cb image.Rectangle
+		tr := s.p.TileRect(ci.Canvas).Intersect(region)
+		for y := tr.Min.Y; y < tr.Max.Y; y++ {
+			o := out.PixOffset(tr.Min.X, y)
+			before := c1.Image.Pix[o : o+tr.Dx()]
+			after := c2.Image.Pix[o : o+tr.Dx()]
+			for x := range after {
+				if before[x] == after[x] {
+					continue
+				}
+				dc.Changed++
+				cb = cb.Union(image.Rect(tr.Min.X+x, y, tr.Min.X+x+1, y+1))
+				if mask {
+					out.Pix[o+x] = 1
+				} else {
+					out.Pix[o+x] = after[x]
+				}
+			}
+		}
+		dc.Bounds = makeDiffRect(cb)
+		sum.Canvases = append(sum.Canvases, dc)
+		sum.Changed += dc.Changed
+		bounds = bounds.Union(cb)
+	}
+	sum.Bounds = makeDiffRect(bounds)
+	return out, sum, nil
+}
+
+// diffHandler shows what changed between two times, as an image of the
+// changed pixels or a JSON summary of how many changed where. The x, y, w
+// and h parameters limit it to a region, and mode=mask draws a highlight
+// mask instead of the new colors.
+func (s *server) diffHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ts1, _ := strconv.Atoi(vars["ts1"])
+	ts2, _ := strconv.Atoi(vars["ts2"])
+	format := vars["format"]
+
+	region, err := s.regionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = "color"
+	case "color", "mask":
+	default:
+		http.Error(w, "mode must be color or mask", 400)
+		return
+	}
+
+	// the diff only depends on the options and which frames are compared
+	parts := []string{s.p.Name, format, mode, fmt.Sprint(ts1, ts2, region)}
+	for _, ts := range []int{ts1, ts2} {
+		for _, ci := range s.dr.CompositeInfo(ts, delta.CompositeOptions{Region: region}) {
+			if !ci.Missing {
+				parts = append(parts, ci.Name)
+			}
+		}
+		parts = append(parts, "")
+	}
+	key := s.renderKey("diff", parts...)
+	w.Header().Add("cache-control", "max-age=25920000")
+	if checkETag(w, r, key) {
+		return
+	}
+
+	data, err := s.rc.Get(key, func() ([]byte, error) {
+		im, sum, err := s.diff(ts1, ts2, region, mode == "mask")
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if format == "json" {
+			err = json.NewEncoder(&buf).Encode(sum)
+		} else {
+			enc := png.Encoder{CompressionLevel: png.BestSpeed}
+			err = enc.Encode(&buf, im)
+		}
+		return buf.Bytes(), err
+	})
+	if errors.Is(err, delta.ErrNoFrames) {
+		http.Error(w, err.Error(), 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	setETag(w, key)
+	if format == "json" {
+		w.Header().Set("content-type", "application/json")
+	} else {
+		w.Header().Set("content-type", "image/png")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/delta"
+)
+
+const (
+	maxFullScale     = 16
+	maxFullDownscale = 64
+	// maxFullPixels bounds the size of an upscaled render
+	maxFullPixels = 1 << 26
+)
+
+// fullOptions are the query parameters of a full canvas render.
+type fullOptions struct {
+	// Region is the part of the canvas to render, before cropping.
+	Region image.Rectangle
+	// Crop is "auto", to trim blank 500px bands from the edges, "bounds", to
+	// trim to the bounding box of colored pixels, or "none".
+	Crop string
+	// Scale magnifies each pixel into a Scale x Scale block, and Downscale
+	// takes the most common color of each Downscale x Downscale block.
+	Scale, Downscale int
+}
+
+// fullOptions parses the x, y, w, h, crop, scale and downscale parameters.
+// Crop defaults to auto for the whole canvas and none for an explicit region.
+func (s *server) fullOptions(r *http.Request) (fullOptions, error) {
+	vals := r.URL.Query()
+	opts := fullOptions{Crop: "auto", Scale: 1, Downscale: 1}
+	var err error
+	if opts.Region, err = s.regionParam(r); err != nil {
+		return opts, err
+	}
+	for _, k := range []string{"x", "y", "w", "h"} {
+		if vals.Has(k) {
+			opts.Crop = "none"
+		}
+	}
+	switch c := vals.Get("crop"); c {
+	case "":
+	case "auto", "none", "bounds":
+		opts.Crop = c
+	default:
+		return opts, errors.New("crop must be auto, none or bounds")
+	}
+	for _, sp := range []struct {
+		k   string
+		v   *int
+		max int
+	}{{"scale", &opts.Scale, maxFullScale}, {"downscale", &opts.Downscale, maxFullDownscale}} {
+		if q := vals.Get(sp.k); q != "" {
+			n, err := strconv.Atoi(q)
+			if err != nil || n < 1 || n > sp.max {
+				return opts, fmt.Errorf("%s must be from 1 to %d", sp.k, sp.max)
+			}
+			*sp.v = n
+		}
+	}
+	if opts.Scale > 1 && opts.Downscale > 1 {
+		return opts, errors.New("scale and downscale can't be combined")
+	}
+	if opts.Region.Dx()*opts.Region.Dy()*opts.Scale*opts.Scale > maxFullPixels {
+		return opts, fmt.Errorf("at most %d output pixels", maxFullPixels)
+	}
+	return opts, nil
+}
+
+// fullHandler serves the whole canvas at a moment. The X-Crop-* headers give
+// the part of the canvas shown, in canvas coordinates, before scaling.
+func (s *server) fullHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ts, _ := strconv.Atoi(vars["ts"])
+
+	opts, err := s.fullOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	fullReq := r.URL.Query().Has("full")
+
+	maxTs := s.dr.LatestBefore(ts)
+	if maxTs != ts && !fullReq {
+		target := fmt.Sprintf("%d.png", maxTs)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	// the image only depends on the options and which frames it's built from
+	parts := []string{s.p.Name, fmt.Sprintf("%+v", opts)}
+	found := false
+	for _, ci := range s.dr.CompositeInfo(ts, delta.CompositeOptions{Region: opts.Region}) {
+		if !ci.Missing {
+			parts = append(parts, ci.Name)
+			found = true
+		}
+	}
+	if !found {
+		w.WriteHeader(404)
+		return
+	}
+	key := s.renderKey("full", parts...)
+	if checkETag(w, r, key) {
+		return
+	}
+
+	data, err := s.rc.Get(key, func() ([]byte, error) {
+		return s.renderFull(ts, opts)
+	})
+	if err == delta.ErrNoFrames {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	setETag(w, key)
+	w.Header().Add("cache-control", "max-age=25920000")
+	// renders start with the crop rectangle, which isn't in the PNG
+	for i, h := range []string{"x-crop-x", "x-crop-y", "x-crop-width", "x-crop-height"} {
+		w.Header().Set(h, strconv.Itoa(int(binary.BigEndian.Uint32(data[i*4:]))))
+	}
+	w.Header().Set("content-type", "image/png")
+	w.Write(data[16:])
+}
+
+// renderFull stitches the canvas at ts, crops and scales it, and encodes it
+// as a PNG preceded by the crop rectangle as four big endian uint32s: x, y,
+// width and height.
+func (s *server) renderFull(ts int, opts fullOptions) ([]byte, error) {
+	c, err := s.dr.Composite(ts, delta.CompositeOptions{Region: opts.Region})
+	if err != nil {
+		return nil, err
+	}
+	out := c.Image
+
+	blank := func(c uint8) bool {
+		return c == 0 || c == s.p.Blank
+	}
+	crop := out.Rect
+	switch opts.Crop {
+	case "auto":
+		crop = autoCrop(out, blank)
+	case "bounds":
+		crop = boundsCrop(out, blank)
+	}
+
+	cropped := image.NewPaletted(image.Rect(0, 0, crop.Dx(), crop.Dy()), out.Palette)
+	for y := crop.Min.Y; y < crop.Max.Y; y++ {
+		copy(cropped.Pix[cropped.PixOffset(0, y-crop.Min.Y):], out.Pix[out.PixOffset(crop.Min.X, y):out.PixOffset(crop.Max.X, y)])
+	}
+	if opts.Scale > 1 {
+		cropped = upscale(cropped, opts.Scale)
+	} else if opts.Downscale > 1 {
+		cropped = downsample(cropped, opts.Downscale)
+	}
+
+	var buf bytes.Buffer
+	for _, v := range []int{crop.Min.X, crop.Min.Y, crop.Dx(), crop.Dy()} {
+		binary.Write(&buf, binary.BigEndian, uint32(v))
+	}
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(&buf, cropped); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// blankRect reports whether every pixel of r is blank.
+func blankRect(im *image.Paletted, r image.Rectangle, blank func(uint8) bool) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for _, c := range im.Pix[im.PixOffset(r.Min.X, y):im.PixOffset(r.Max.X, y)] {
+			if !blank(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// autoCrop trims blank 500px bands from each edge of im, leaving at least
+// 500px each way.
+func autoCrop(im *image.Paletted, blank func(uint8) bool) image.Rectangle {
+	c := im.Rect
+	for c.Dx() > 500 && blankRect(im, image.Rect(c.Min.X, c.Min.Y, c.Min.X+500, c.Max.Y), blank) {
+		c.Min.X += 500
+	}
+	for c.Dx() > 500 && blankRect(im, image.Rect(c.Max.X-500, c.Min.Y, c.Max.X, c.Max.Y), blank) {
+		c.Max.X -= 500
+	}
+	for c.Dy() > 500 && blankRect(im, image.Rect(c.Min.X, c.Min.Y, c.Max.X, c.Min.Y+500), blank) {
+		c.Min.Y += 500
+	}
+	for c.Dy() > 500 && blankRect(im, image.Rect(c.Min.X, c.Max.Y-500, c.Max.X, c.Max.Y), blank) {
+		c.Max.Y -= 500
+	}
+	return c
+}
+
+// boundsCrop returns the bounding box of the pixels of im that aren't blank,
+// or all of im if they all are.
+func boundsCrop(im *image.Paletted, blank func(uint8) bool) image.Rectangle {
+	var c image.Rectangle
+	for y := im.Rect.Min.Y; y < im.Rect.Max.Y; y++ {
+		row := im.Pix[im.PixOffset(im.Rect.Min.X, y):im.PixOffset(im.Rect.Max.X, y)]
+		for i, p := range row {
+			if !blank(p) {
+				c = c.Union(image.Rect(im.Rect.Min.X+i, y, im.Rect.Min.X+i+1, y+1))
+			}
+		}
+	}
+	if c.Empty() {
+		return im.Rect
+	}
+	return c
+}
+
+// upscale magnifies each pixel of im into a scale x scale block.
+func upscale(im *image.Paletted, scale int) *image.Paletted {
+	r := im.Rect
+	out := image.NewPaletted(image.Rect(0, 0, r.Dx()*scale, r.Dy()*scale), im.Palette)
+	for y := 0; y < r.Dy(); y++ {
+		row := out.Pix[out.PixOffset(0, y*scale):out.PixOffset(0, y*scale+1)]
+		for x, c := range im.Pix[im.PixOffset(r.Min.X, r.Min.Y+y):im.PixOffset(r.Max.X, r.Min.Y+y)] {
+			for i := 0; i < scale; i++ {
+				row[x*scale+i] = c
+			}
+		}
+		for i := 1; i < scale; i++ {
+			copy(out.Pix[out.PixOffset(0, y*scale+i):], row)
+		}
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"compress/lzw"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+)
+
+// gifWriter streams a looping GIF a frame at a time, unlike gif.EncodeAll,
+// which needs every frame up front. Palette index 0 is transparent, so
+// frames only need to hold the pixels that changed.
+type gifWriter struct {
+	w        *bufio.Writer
+	litWidth int
+	err      error
+}
+
+func newGifWriter(w io.Writer, width, height int, pal color.Palette) *gifWriter {
+	g := &gifWriter{w: bufio.NewWriter(w), litWidth: 2}
+	for 1<<g.litWidth < len(pal) {
+		g.litWidth++
+	}
+
+	var buf [13]byte
+	copy(buf[:], "GIF89a")
+	binary.LittleEndian.PutUint16(buf[6:], uint16(width))
+	binary.LittleEndian.PutUint16(buf[8:], uint16(height))
+	// global color table, 8 bit color resolution
+	buf[10] = 0x80 | 0x70 | uint8(g.litWidth-1)
+	g.w.Write(buf[:])
+
+	for i := 0; i < 1<<g.litWidth; i++ {
+		c := color.RGBAModel.Convert(color.Black).(color.RGBA)
+		if i < len(pal) {
+			c = color.RGBAModel.Convert(pal[i]).(color.RGBA)
+		}
+		g.w.Write([]byte{c.R, c.G, c.B})
+	}
+
+	// loop forever
+	g.w.Write([]byte{0x21, 0xff, 0x0b})
+	g.w.WriteString("NETSCAPE2.0")
+	g.w.Write([]byte{0x03, 0x01, 0x00, 0x00, 0x00})
+	return g
+}
+
+// WriteFrame writes im at its position on the logical screen, drawn over the
+// previous frames, and shows it for delay hundredths of a second.
+func (g *gifWriter) WriteFrame(im *image.Paletted, delay int) error {
+	if g.err != nil {
+		return g.err
+	}
+	r := im.Rect
+	var buf [10]byte
+	// graphic control: leave the frame in place, index 0 transparent
+	copy(buf[:], []byte{0x21, 0xf9, 0x04, 0x01<<2 | 0x01})
+	binary.LittleEndian.PutUint16(buf[4:], uint16(delay))
+	buf[6], buf[7] = 0, 0
+	g.w.Write(buf[:8])
+
+	buf[0] = 0x2c
+	binary.LittleEndian.PutUint16(buf[1:], uint16(r.Min.X))
+	binary.LittleEndian.PutUint16(buf[3:], uint16(r.Min.Y))
+	binary.LittleEndian.PutUint16(buf[5:], uint16(r.Dx()))
+	binary.LittleEndian.PutUint16(buf[7:], uint16(r.Dy()))
+	buf[9] = 0
+	g.w.Write(buf[:10])
+
+	g.w.WriteByte(uint8(g.litWidth))
+	bw := &gifBlockWriter{w: g.w}
+	lw := lzw.NewWriter(bw, lzw.LSB, g.litWidth)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		if _, err := lw.Write(im.Pix[im.PixOffset(r.Min.X, y):][:r.Dx()]); err != nil {
+			g.err = err
+			return err
+		}
+	}
+	if err := lw.Close(); err != nil {
+		g.err = err
+		return err
+	}
+	bw.flush()
+	if bw.err == nil {
+		bw.err = g.w.WriteByte(0)
+	}
+	g.err = bw.err
+	return g.err
+}
+
+// Close finishes the GIF. It doesn't close the underlying writer.
+func (g *gifWriter) Close() error {
+	if g.err != nil {
+		return g.err
+	}
+	g.w.WriteByte(0x3b)
+	return g.w.Flush()
+}
+
+// gifBlockWriter splits image data into the sub-blocks of at most 255 bytes
+// that GIF requires.
+type gifBlockWriter struct {
+	w   *bufio.Writer
+	buf [255]byte
+	n   int
+	err error
+}
+
+func (b *gifBlockWriter) Write(p []byte) (int, error) {
+	for i, c := range p {
+		b.buf[b.n] = c
+		b.n++
+		if b.n == len(b.buf) {
+			b.flush()
+			if b.err != nil {
+				return i, b.err
+			}
+		}
+	}
+	return len(p), b.err
+}
+
+func (b *gifBlockWriter) flush() {
+	if b.n == 0 || b.err != nil {
+		return
+	}
+	b.w.WriteByte(uint8(b.n))
+	_, b.err = b.w.Write(b.buf[:b.n])
+	b.n = 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"testing"
+
+	"github.com/rmmh/rplace/palette"
+)
+
+func TestGifWriter(t *testing.T) {
+	pal := palette.Palette2017.Colors
+	var buf bytes.Buffer
+	gw := newGifWriter(&buf, 4, 4, pal)
+	full := image.NewPaletted(image.Rect(0, 0, 4, 4), pal)
+	for i := range full.Pix {
+		full.Pix[i] = 1
+	}
+	patch := image.NewPaletted(image.Rect(1, 2, 3, 3), pal)
+	patch.Pix[0], patch.Pix[1] = 5, 6
+	if err := gw.WriteFrame(full, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.WriteFrame(patch, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 || g.Delay[0] != 10 || g.Delay[1] != 20 || g.LoopCount != 0 {
+		t.Fatalf("%d frames with delays %v and loop count %d", len(g.Image), g.Delay, g.LoopCount)
+	}
+	if r := g.Image[1].Rect; r != patch.Rect {
+		t.Errorf("second frame at %v, want %v", r, patch.Rect)
+	}
+	if c := g.Image[1].ColorIndexAt(2, 2); c != 6 {
+		t.Errorf("second frame pixel = %d, want 6", c)
+	}
+}
+
+// failWriter fails every write after the first n bytes.
+type failWriter struct{ n int }
+
+var errClientGone = errors.New("client gone")
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errClientGone
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestGifWriterError(t *testing.T) {
+	pal := palette.Palette2017.Colors
+	gw := newGifWriter(&failWriter{n: 100}, 256, 256, pal)
+	im := image.NewPaletted(image.Rect(0, 0, 256, 256), pal)
+	for i := range im.Pix {
+		im.Pix[i] = uint8(1 + i*7%16)
+	}
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		err = gw.WriteFrame(im, 2)
+	}
+	if !errors.Is(err, errClientGone) {
+		t.Fatalf("WriteFrame err = %v, want the write's error", err)
+	}
+	if err := gw.Close(); !errors.Is(err, errClientGone) {
+		t.Errorf("Close err = %v, want the write's error", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/columnar"
+)
+
+const (
+	defaultHotCell  = 50
+	defaultHotCount = 10
+	maxHotCount     = 1000
+)
+
+type heatmapSummary struct {
+	From    int64             `json:"from"`
+	To      int64             `json:"to"`
+	Region  *diffRect         `json:"region"`
+	Total   int               `json:"total"`
+	Max     uint32            `json:"max"`
+	Cell    int               `json:"cell"`
+	Hottest []columnar.Region `json:"hottest"`
+}
+
+type heatmapParams struct {
+	From, To         int64
+	Region           image.Rectangle
+	Scale, Downscale int
+	Max              uint32
+	Cell, N          int
+	JSON             bool
+}
+
+// heatmapParams parses the query parameters of a heatmap: the from/to window,
+// an x, y, w, h region, and for images scale, downscale and a fixed max count
+// for the brightest color, or for JSON the cell size and count n of the
+// hottest regions to list.
+func (s *server) heatmapParams(r *http.Request) (heatmapParams, error) {
+	vals := r.URL.Query()
+	hp := heatmapParams{Scale: 1, Downscale: 1, Cell: defaultHotCell, N: defaultHotCount}
+	var err error
+	if hp.From, hp.To, err = timeRange(r); err != nil {
+		return hp, err
+	}
+	if hp.From < int64(s.col.StartTs) {
+		hp.From = int64(s.col.StartTs)
+	}
+	if hp.To > int64(s.col.EndTs) {
+		hp.To = int64(s.col.EndTs)
+	}
+	if hp.Region, err = s.regionParam(r); err != nil {
+		return hp, err
+	}
+	for _, ip := range []struct {
+		k        string
+		v        *int
+		min, max int
+	}{
+		{"scale", &hp.Scale, 1, maxFullScale},
+		{"downscale", &hp.Downscale, 1, maxFullDownscale},
+		{"cell", &hp.Cell, 1, 1000},
+		{"n", &hp.N, 1, maxHotCount},
+	} {
+		if q := vals.Get(ip.k); q != "" {
+			n, err := strconv.Atoi(q)
+			if err != nil || n < ip.min || n > ip.max {
+				return hp, fmt.Errorf("%s must be from %d to %d", ip.k, ip.min, ip.max)
+			}
+			*ip.v = n
+		}
+	}
+	if q := vals.Get("max"); q != "" {
+		n, err := strconv.ParseUint(q, 10, 32)
+		if err != nil {
+			return hp, fmt.Errorf("bad max")
+		}
+		hp.Max = uint32(n)
+	}
+	if hp.Scale > 1 && hp.Downscale > 1 {
+		return hp, fmt.Errorf("scale and downscale can't be combined")
+	}
+	if hp.Region.Dx()*hp.Region.Dy()*hp.Scale*hp.Scale > maxFullPixels {
+		return hp, fmt.Errorf("at most %d output pixels", maxFullPixels)
+	}
+	hp.JSON = mux.Vars(r)["format"] == "json"
+	return hp, nil
+}
+
+// heatmapHandler renders how often each pixel changed over a time window, or
+// with the json format lists the regions that changed most.
+func (s *server) heatmapHandler(w http.ResponseWriter, r *http.Request) {
+	hp, err := s.heatmapParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	key := s.renderKey("heatmap", s.col.ID, fmt.Sprintf("%+v", hp))
+	if checkETag(w, r, key) {
+		return
+	}
+	data, err := s.rc.Get(key, func() ([]byte, error) {
+		h := s.col.Heatmap(hp.From, hp.To, hp.Region)
+		var buf bytes.Buffer
+		if hp.JSON {
+			err := json.NewEncoder(&buf).Encode(heatmapSummary{
+				From:    hp.From,
+				To:      hp.To,
+				Region:  makeDiffRect(h.Rect),
+				Total:   h.Total,
+				Max:     h.Max,
+				Cell:    hp.Cell,
+				Hottest: h.Hottest(hp.Cell, hp.N),
+			})
+			return buf.Bytes(), err
+		}
+		if hp.Downscale > 1 {
+			h = h.Downscale(hp.Downscale)
+		}
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		err := enc.Encode(&buf, h.Image(hp.Max, hp.Scale))
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	setETag(w, key)
+	if hp.JSON {
+		w.Header().Set("content-type", "application/json")
+	} else {
+		w.Header().Set("content-type", "image/png")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/delta"
+)
+
+// jobSettings configure the render job queue.
+type jobSettings struct {
+	// Dir holds finished renders, alongside any other files. Jobs are
+	// disabled when it's empty.
+	Dir     string `json:"dir"`
+	Workers int    `json:"workers"`
+	// Queue bounds the jobs waiting for a worker.
+	Queue int `json:"queue"`
+	// PerClient bounds the queued and running jobs of each client.
+	PerClient int `json:"perClient"`
+	// Expiry is how long finished jobs and their results are kept.
+	Expiry duration `json:"expiry"`
+	// ClientHeader names a header, such as X-Forwarded-For, whose first
+	// value identifies clients instead of their address, for use behind a
+	// proxy.
+	ClientHeader string `json:"clientHeader"`
+	// Limits bound the timelapses jobs render, which can be larger than
+	// those rendered while the client waits.
+	Limits gifLimits `json:"limits"`
+}
+
+// jobSpec is the render a job makes: a timelapse of the w x h area at (x, y)
+// from From to To, one frame per Interval, as an animated GIF or a zip of
+// PNG frames. Times are Unix milliseconds or RFC3339, and intervals
+// milliseconds or Go durations.
+type jobSpec struct {
+	Format   string    `json:"format"`
+	X        int       `json:"x"`
+	Y        int       `json:"y"`
+	W        int       `json:"w"`
+	H        int       `json:"h"`
+	From     jsonParam `json:"from"`
+	To       jsonParam `json:"to"`
+	Interval jsonParam `json:"interval"`
+	Scale    int       `json:"scale"`
+	// Delay is the GIF frame delay in hundredths of a second.
+	Delay int `json:"delay"`
+}
+
+// jsonParam is a query-style parameter that may be given in JSON as either a
+// number or a string.
+type jsonParam string
+
+func (p *jsonParam) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*p = jsonParam(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*p = jsonParam(n)
+	return nil
+}
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+type job struct {
+	ID       string    `json:"id"`
+	Dataset  string    `json:"dataset"`
+	Spec     jobSpec   `json:"spec"`
+	State    string    `json:"state"`
+	Frame    int       `json:"frame"`
+	Frames   int       `json:"frames"`
+	Error    string    `json:"error,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+
+	client string
+	file   string
+	run    func(w io.Writer, progress func(frame, frames int) error) error
+	// release is called once the job has run, if it isn't nil.
+	release func()
+}
+
+// jobManager runs render jobs on a bounded pool of workers, writing their
+// results to files that are deleted once they expire.
+type jobManager struct {
+	cfg   jobSettings
+	queue chan *job
+
+	mu      sync.Mutex
+	jobs    map[string]*job
+	clients map[string]int
+}
+
+func newJobManager(cfg jobSettings) (*jobManager, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	// jobs don't outlive the process, so neither do their results
+	ents, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range ents {
+		if e.Type().IsRegular() && jobFileName.MatchString(e.Name()) {
+			os.Remove(filepath.Join(cfg.Dir, e.Name()))
+		}
+	}
+
+	m := &jobManager{
+		cfg:     cfg,
+		queue:   make(chan *job, cfg.Queue),
+		jobs:    make(map[string]*job),
+		clients: make(map[string]int),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go m.work()
+	}
+	go m.expire()
+	return m, nil
+}
+
+// client identifies the client making a request.
+func (m *jobManager) client(r *http.Request) string {
+	if m.cfg.ClientHeader != "" {
+		if v := r.Header.Get(m.cfg.ClientHeader); v != "" {
+			return strings.TrimSpace(strings.Split(v, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// jobFileName matches the names submit gives job results and their
+// temporary files, so the manager leaves anything else in its directory
+// alone.
+var jobFileName = regexp.MustCompile(`^[0-9a-f]{16}\.(gif|zip)(\.tmp)?$`)
+
+var (
+	errTooManyJobs = errors.New("too many jobs from this client; wait for one to finish")
+	errQueueFull   = errors.New("the job queue is full; try again later")
+	errStopping    = errors.New("the server is shutting down")
+)
+
+// submit queues j, failing if its client has too many jobs or the queue is
+// full.
+func (m *jobManager) submit(j *job) error {
+	var id [8]byte
+	rand.Read(id[:])
+	j.ID = hex.EncodeToString(id[:])
+	j.file = j.ID + "." + j.Spec.Format
+	j.State = jobQueued
+	j.Created = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// once stopping, the queue is drained with the lock held
+	if stopping.Err() != nil {
+		return errStopping
+	}
+	if m.clients[j.client] >= m.cfg.PerClient {
+		return errTooManyJobs
+	}
+	select {
+	case m.queue <- j:
+	default:
+		return errQueueFull
+	}
+	m.clients[j.client]++
+	m.jobs[j.ID] = j
+	return nil
+}
+
+// get returns a snapshot of a job.
+func (m *jobManager) get(id string) (job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+func (m *jobManager) work() {
+	for {
+		var j *job
+		select {
+		case j = <-m.queue:
+		case <-stopping.Done():
+			m.drain()
+			return
+		}
+
+		m.mu.Lock()
+		j.State = jobRunning
+		m.mu.Unlock()
+
+		size, err := m.render(j)
+
+		m.mu.Lock()
+		m.finish(j, size, err)
+		m.mu.Unlock()
+	}
+}
+
+// drain fails the jobs left in the queue on shutdown.
+func (m *jobManager) drain() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		select {
+		case j := <-m.queue:
+			m.finish(j, 0, errStopping)
+		default:
+			return
+		}
+	}
+}
+
+// finish records the outcome of a job, and releases what it held.
+// lock must be held
+func (m *jobManager) finish(j *job, size int64, err error) {
+	if j.release != nil {
+		j.release()
+	}
+	if err != nil {
+		j.State = jobFailed
+		j.Error = err.Error()
+		log.Printf("job %s: %v", j.ID, err)
+	} else {
+		j.State = jobDone
+		j.Frame = j.Frames
+		j.Size = size
+	}
+	j.Finished = time.Now()
+	m.clients[j.client]--
+	if m.clients[j.client] == 0 {
+		delete(m.clients, j.client)
+	}
+}
+
+// render writes a job's result to a temporary file, renaming it into place
+// once complete.
+func (m *jobManager) render(j *job) (int64, error) {
+	path := filepath.Join(m.cfg.Dir, j.file)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path + ".tmp")
+	bw := bufio.NewWriter(f)
+	err = j.run(bw, func(frame, frames int) error {
+		m.mu.Lock()
+		j.Frame, j.Frames = frame, frames
+		m.mu.Unlock()
+		return stopping.Err()
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	st, err := os.Stat(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), os.Rename(path+".tmp", path)
+}
+
+// expire deletes finished jobs, and their results, once they're older than
+// the expiry.
+func (m *jobManager) expire() {
+	every := time.Minute
+	if d := time.Duration(m.cfg.Expiry) / 2; d < every {
+		every = d
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stopping.Done():
+			return
+		}
+		cutoff := time.Now().Add(-time.Duration(m.cfg.Expiry))
+		m.mu.Lock()
+		for id, j := range m.jobs {
+			if !j.Finished.IsZero() && j.Finished.Before(cutoff) {
+				os.Remove(filepath.Join(m.cfg.Dir, j.file))
+				delete(m.jobs, id)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// newJob checks a render spec and prepares a job to make it.
+func (s *server) newJob(spec jobSpec) (*job, error) {
+	region := image.Rect(spec.X, spec.Y, spec.X+spec.W, spec.Y+spec.H)
+	if !region.In(s.p.Bounds()) {
+		return nil, errors.New("region must be within the canvas")
+	}
+	if spec.Scale == 0 {
+		spec.Scale = 1
+	}
+	if spec.Delay == 0 {
+		spec.Delay = 2
+	}
+	if spec.Delay < 1 || spec.Delay > maxGifDelay {
+		return nil, fmt.Errorf("delay must be 1-%d hundredths of a second", maxGifDelay)
+	}
+
+	start, end := s.p.Start, s.p.End
+	if spec.Format == "gif" {
+		if s.col == nil {
+			return nil, errors.New("gifs need a columnar file")
+		}
+		start, end = int64(s.col.StartTs), int64(s.col.EndTs)
+	} else if spec.Format != "zip" {
+		return nil, errors.New("format must be gif or zip")
+	}
+	from, to, interval := start, end, int64(60_000)
+	var err error
+	if spec.From != "" {
+		if from, err = parseTime(string(spec.From)); err != nil {
+			return nil, fmt.Errorf("bad from: %w", err)
+		}
+	}
+	if spec.To != "" {
+		if to, err = parseTime(string(spec.To)); err != nil {
+			return nil, fmt.Errorf("bad to: %w", err)
+		}
+	}
+	if spec.Interval != "" {
+		if interval, err = parseInterval(string(spec.Interval)); err != nil {
+			return nil, fmt.Errorf("bad interval: %w", err)
+		}
+	}
+	interval, frameCount, err := s.jobs.cfg.Limits.checkTimelapse(spec.W, spec.H, spec.Scale, from, to, interval, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &job{Dataset: s.name, Spec: spec, Frames: frameCount}
+	if spec.Format == "gif" {
+		g := gifParams{
+			cx: spec.X + spec.W/2, cy: spec.Y + spec.H/2, width: spec.W, height: spec.H, scale: spec.Scale,
+			from: from, interval: interval, frameCount: frameCount, delay: spec.Delay,
+		}
+		j.run = func(w io.Writer, progress func(frame, frames int) error) error {
+			return s.writeGif(w, g, progress)
+		}
+	} else {
+		j.run = func(w io.Writer, progress func(frame, frames int) error) error {
+			return s.writeFrameZip(w, region, spec.Scale, from, interval, frameCount, progress)
+		}
+	}
+	return j, nil
+}
+
+// writeFrameZip writes a zip of the region's frames, one PNG per interval
+// named by its time. Times without frames are left out, and it fails if they
+// all are.
+func (s *server) writeFrameZip(w io.Writer, region image.Rectangle, scale int, from, interval int64, frames int, progress func(frame, frames int) error) error {
+	zw := zip.NewWriter(w)
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	written := 0
+	for f := 0; f < frames; f++ {
+		if err := progress(f, frames); err != nil {
+			return err
+		}
+		ts := from + int64(f+1)*interval
+		c, err := s.dr.Composite(int(ts), delta.CompositeOptions{Region: region})
+		if err == delta.ErrNoFrames {
+			continue
+		} else if err != nil {
+			return err
+		}
+		im := c.Image
+		if scale > 1 {
+			im = upscale(im, scale)
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%d.png", ts), Method: zip.Store, Modified: time.UnixMilli(ts)})
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(fw, im); err != nil {
+			return err
+		}
+		written++
+	}
+	if written == 0 {
+		return delta.ErrNoFrames
+	}
+	return zw.Close()
+}
+
+// jobsHandler accepts a JSON jobSpec and queues a job to render it,
+// responding with the job and a Location to poll.
+func (s *server) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	var spec jobSpec
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		http.Error(w, "bad job spec: "+err.Error(), 400)
+		return
+	}
+	j, err := s.newJob(spec)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	j.client = s.jobs.client(r)
+	// the job may run after a reload has retired this server
+	s.files.acquire()
+	j.release = s.files.release
+	err = s.jobs.submit(j)
+	if err != nil {
+		s.files.release()
+	}
+	if err == errTooManyJobs {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		w.Header().Set("retry-after", "60")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("location", s.prefix+"jobs/"+j.ID)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	snap, _ := s.jobs.get(j.ID)
+	json.NewEncoder(w).Encode(snap)
+}
+
+// jobHandler reports a job's state and progress.
+func (s *server) jobHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.jobs.get(mux.Vars(r)["id"])
+	if !ok || j.Dataset != s.name {
+		http.Error(w, "no such job", 404)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	json.NewEncoder(w).Encode(j)
+}
+
+// jobResultHandler serves a finished job's result.
+func (s *server) jobResultHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.jobs.get(mux.Vars(r)["id"])
+	if !ok || j.Dataset != s.name {
+		http.Error(w, "no such job", 404)
+		return
+	}
+	if j.State != jobDone {
+		http.Error(w, "job is "+j.State, http.StatusConflict)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.jobs.cfg.Dir, j.file))
+	if err != nil {
+		http.Error(w, "result has expired", http.StatusGone)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%q", s.name+j.file))
+	if j.Spec.Format == "gif" {
+		w.Header().Set("content-type", "image/gif")
+	} else {
+		w.Header().Set("content-type", "application/zip")
+	}
+	w.Header().Set("content-length", strconv.FormatInt(j.Size, 10))
+	http.ServeContent(w, r, "", j.Finished, f)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rmmh/rplace/profile"
+)
+
+func TestJobManagerKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]bool{
+		"0123456789abcdef.gif":     false,
+		"0123456789abcdef.zip.tmp": false,
+		"0123456789abcdef.png":     true,
+		"notes.gif":                true,
+		"README":                   true,
+	}
+	for name := range files {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	if _, err := newJobManager(jobSettings{Dir: dir, Queue: 1, Expiry: duration(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	for name, keep := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != keep {
+			t.Errorf("%s: stat err %v, want kept %v", name, err, keep)
+		}
+	}
+}
+
+func TestSubmitLimits(t *testing.T) {
+	// with no workers, submitted jobs stay queued
+	m := &jobManager{
+		cfg:     jobSettings{Queue: 2, PerClient: 1},
+		queue:   make(chan *job, 2),
+		jobs:    make(map[string]*job),
+		clients: make(map[string]int),
+	}
+	for _, tc := range []struct {
+		client string
+		err    error
+	}{
+		{"a", nil},
+		{"a", errTooManyJobs},
+		{"b", nil},
+		{"c", errQueueFull},
+	} {
+		j := &job{client: tc.client, Spec: jobSpec{Format: "gif"}}
+		if err := m.submit(j); err != tc.err {
+			t.Errorf("client %s: submit = %v, want %v", tc.client, err, tc.err)
+		}
+		if !jobFileName.MatchString(j.file) {
+			t.Errorf("job file %q isn't cleaned up at startup", j.file)
+		}
+	}
+	if len(m.jobs) != 2 {
+		t.Errorf("%d jobs known, want the 2 queued", len(m.jobs))
+	}
+}
+
+// waitJob polls a job until it finishes.
+func waitJob(t *testing.T, m *jobManager, id string) job {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if j, _ := m.get(id); j.State == jobDone || j.State == jobFailed {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s didn't finish", id)
+	return job{}
+}
+
+func TestJobRunAndExpire(t *testing.T) {
+	dir := t.TempDir()
+	m, err := newJobManager(jobSettings{Dir: dir, Workers: 1, Queue: 4, PerClient: 4, Expiry: duration(200 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	released := 0
+	ok := &job{client: "a", Spec: jobSpec{Format: "zip"}, release: func() { released++ }}
+	ok.run = func(w io.Writer, progress func(frame, frames int) error) error {
+		for f := 0; f < 3; f++ {
+			if err := progress(f, 3); err != nil {
+				return err
+			}
+			w.Write([]byte("frame"))
+		}
+		return nil
+	}
+	if err := m.submit(ok); err != nil {
+		t.Fatal(err)
+	}
+	j := waitJob(t, m, ok.ID)
+	if j.State != jobDone || j.Size != 15 || j.Frame != j.Frames || released != 1 {
+		t.Errorf("finished job %+v, released %d times", j, released)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, j.file)); err != nil || string(b) != "frameframeframe" {
+		t.Errorf("result %q, %v", b, err)
+	}
+
+	bad := &job{client: "a", Spec: jobSpec{Format: "gif"}}
+	bad.run = func(w io.Writer, progress func(frame, frames int) error) error {
+		w.Write([]byte("partial"))
+		return errors.New("render failed")
+	}
+	if err := m.submit(bad); err != nil {
+		t.Fatal(err)
+	}
+	if j := waitJob(t, m, bad.ID); j.State != jobFailed || j.Error != "render failed" {
+		t.Errorf("failed job %+v", j)
+	}
+	m.mu.Lock()
+	clients := len(m.clients)
+	m.mu.Unlock()
+	if clients != 0 {
+		t.Errorf("%d clients still counted with no jobs left", clients)
+	}
+
+	// finished jobs and their results go once they expire
+	for i := 0; i < 100; i++ {
+		if _, found := m.get(ok.ID); !found {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, found := m.get(ok.ID); found {
+		t.Fatal("job didn't expire")
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+		t.Errorf("%d files left after the jobs expired", len(ents))
+	}
+}
+
+func TestJobDrain(t *testing.T) {
+	m := &jobManager{
+		cfg:     jobSettings{Queue: 2, PerClient: 2},
+		queue:   make(chan *job, 2),
+		jobs:    make(map[string]*job),
+		clients: make(map[string]int),
+	}
+	released := 0
+	j := &job{client: "a", Spec: jobSpec{Format: "zip"}, release: func() { released++ }}
+	if err := m.submit(j); err != nil {
+		t.Fatal(err)
+	}
+	m.drain()
+	if snap, _ := m.get(j.ID); snap.State != jobFailed || released != 1 || len(m.clients) != 0 {
+		t.Errorf("drained job %+v, released %d times, %d clients", snap, released, len(m.clients))
+	}
+}
+
+func TestJobClient(t *testing.T) {
+	for _, tc := range []struct {
+		header, value, remote, want string
+	}{
+		{"", "", "1.2.3.4:5678", "1.2.3.4"},
+		{"", "", "[::1]:5678", "::1"},
+		{"", "", "@", "@"},
+		{"X-Forwarded-For", "9.9.9.9, 1.2.3.4", "1.2.3.4:5678", "9.9.9.9"},
+		{"X-Forwarded-For", "", "1.2.3.4:5678", "1.2.3.4"},
+	} {
+		m := &jobManager{cfg: jobSettings{ClientHeader: tc.header}}
+		r := httptest.NewRequest("POST", "/jobs", nil)
+		r.RemoteAddr = tc.remote
+		if tc.value != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		if got := m.client(r); got != tc.want {
+			t.Errorf("client(%s: %q, from %s) = %q, want %q", tc.header, tc.value, tc.remote, got, tc.want)
+		}
+	}
+}
+
+func TestJobSpecParams(t *testing.T) {
+	var spec jobSpec
+	if err := json.Unmarshal([]byte(`{"from": 1490918400000, "to": "2017-04-01T00:00:00Z", "interval": "1m"}`), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.From != "1490918400000" || spec.To != "2017-04-01T00:00:00Z" || spec.Interval != "1m" {
+		t.Errorf("read %+v", spec)
+	}
+	if err := json.Unmarshal([]byte(`{"from": true}`), &spec); err == nil {
+		t.Error("read a bool as a time")
+	}
+}
+
+func TestNewJob(t *testing.T) {
+	p, err := profile.Lookup("2017")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// jobs have their own limits, larger than those of /gif
+	s := &server{
+		name: "test", p: p,
+		gif:  gifLimits{MaxFrames: 10, MaxPixels: 5 * 5, MaxScale: 1, MinInterval: duration(time.Hour)},
+		jobs: &jobManager{cfg: jobSettings{Limits: gifLimits{MaxFrames: 1 << 20, MaxPixels: 100 * 100, MaxScale: 2, MinInterval: duration(time.Second)}}},
+	}
+	j, err := s.newJob(jobSpec{Format: "zip", W: 10, H: 10, Interval: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Spec.Scale != 1 || j.Spec.Delay != 2 || j.Frames != int((p.End-p.Start+3_600_000-1)/3_600_000) {
+		t.Errorf("job %+v", j)
+	}
+	for _, tc := range []struct {
+		name string
+		spec jobSpec
+		err  string
+	}{
+		{"off the canvas", jobSpec{Format: "zip", X: 995, W: 10, H: 10}, "within the canvas"},
+		{"bad format", jobSpec{Format: "png", W: 10, H: 10}, "format"},
+		{"gif without columnar data", jobSpec{Format: "gif", W: 10, H: 10}, "columnar"},
+		{"scale too big", jobSpec{Format: "zip", W: 10, H: 10, Scale: 3}, "scale"},
+		{"bad delay", jobSpec{Format: "zip", W: 10, H: 10, Delay: -1}, "delay"},
+		{"bad from", jobSpec{Format: "zip", W: 10, H: 10, From: "yesterday"}, "from"},
+	} {
+		if _, err := s.newJob(tc.spec); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: err = %v, want one about %s", tc.name, err, tc.err)
+		}
+	}
+}
@@ -1,186 +1,84 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"image"
 	"image/color"
-	"image/gif"
 	"image/png"
 	"io"
 	"log"
-	"math"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"reflect"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/image/draw"
 
+	"github.com/rmmh/rplace/columnar"
 	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/profile"
 )
 
 type server struct {
-	dr  *delta.DeltaReader
-	col *ColumnarReader
+	// name is the dataset's name, and prefix the path it's served under
+	name, prefix string
+	gif          gifLimits
+	// timeout gives the write timeout of each route
+	timeout func(route string) time.Duration
+
+	p     *profile.Profile
+	dr    *delta.DeltaReader
+	col   *columnar.ColumnarReader
+	files *openFiles
+	rc    *renderCache
+	jobs  *jobManager
+	// events lists the event files to replay, in order
+	events []string
 }
 
-func (s *server) fullHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) deltaHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	ts, _ := strconv.Atoi(vars["ts"])
-
-	fullReq := r.URL.Query().Has("full")
-
-	ims := [6]*image.Paletted{}
-
-	maxTs := 0
-	for canvas := 0; canvas < 6; canvas++ {
-		e := s.dr.FindNearestLeft(ts, canvas)
-		if e != nil && e.Ts > maxTs {
-			maxTs = e.Ts
-		}
-	}
-
-	if maxTs != ts && !fullReq {
-		http.Redirect(w, r, fmt.Sprintf("%d.png", maxTs), http.StatusMovedPermanently)
+	quad, _ := strconv.Atoi(vars["quad"])
+	if quad >= s.p.Canvases {
+		http.Error(w, "no such canvas", 404)
 		return
 	}
 
-	for canvas := 0; canvas < 6; canvas++ {
-		e := s.dr.FindNearestLeft(ts, canvas)
-		if e == nil {
-			continue
-		}
-		log.Printf("%d canvas %d -> %s", ts, canvas, e.F.Name)
-		if math.Abs(float64(e.Ts-ts)) < 180_000 {
-			im, err := s.dr.GetImage(e)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			ims[canvas] = im
-		}
-	}
-
-	width := 3000
-	height := 2000
-
-	if ims[1] == nil {
-		w.WriteHeader(404)
+	e, ok := s.dr.FileMap[quad][ts]
+	if !ok {
+		http.Error(w, "no images found", 404)
 		return
 	}
 
-	var out *image.Paletted
-	out = image.NewPaletted(image.Rect(0, 0, width, height), ims[1].Palette)
-	for i, im := range ims {
-		if im == nil {
-			continue
-		}
-		ox := (i % 3) * 1000
-		oy := (i / 3) * 1000
-		for y := 0; y < 1000; y++ {
-			for x := 0; x < 1000; x++ {
-				out.SetColorIndex(x+ox, y+oy, im.ColorIndexAt(x, y))
-			}
-		}
-	}
-
-	var cropleft, cropright, croptop, cropbottom int
-
-cropleft:
-	for ; true; cropleft += 500 {
-		for y := 0; y < height; y++ {
-			for x := 0; x < 500; x++ {
-				c := out.ColorIndexAt(x+cropleft, y)
-				if c != 0 && c != 32 {
-					break cropleft
-				}
-			}
-		}
-	}
-cropright:
-	for ; ; cropright += 500 {
-		for y := 0; y < height; y++ {
-			for x := 1; x <= 500; x++ {
-				c := out.ColorIndexAt(width-x-cropright, y)
-				if c != 0 && c != 32 {
-					break cropright
-				}
-			}
-		}
-	}
-croptop:
-	for ; ; croptop += 500 {
-		for y := 0; y < 500; y++ {
-			for x := 0; x < 3000; x++ {
-				c := out.ColorIndexAt(x, y+croptop)
-				if c != 0 && c != 32 {
-					break croptop
-				}
-			}
-		}
-	}
-cropbottom:
-	for ; ; cropbottom += 500 {
-		for y := 1; y <= 500; y++ {
-			for x := 0; x < width; x++ {
-				c := out.ColorIndexAt(x, height-y-cropbottom)
-				if c != 0 && c != 32 {
-					break cropbottom
-				}
-			}
+	if e.IsSparse() {
+		// the frontends only understand PNG deltas
+		im, err := e.Read()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
-	}
-	cropped := image.NewPaletted(image.Rect(0, 0, width-cropleft-cropright, height-croptop-cropbottom), out.Palette)
-	for y := croptop; y < height-cropbottom; y++ {
-		for x := cropleft; x < width-cropright; x++ {
-			cropped.SetColorIndex(x-cropleft, y-croptop, out.ColorIndexAt(x, y))
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		err = enc.Encode(w, im)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
 		}
-	}
-
-	w.Header().Add("cache-control", "max-age=25920000")
-	enc := png.Encoder{CompressionLevel: png.BestSpeed}
-	err := enc.Encode(w, cropped)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
 		return
 	}
-}
 
-var pal = color.Palette{
-	color.NRGBA{0x0, 0x0, 0x0, 0x0}, color.RGBA{0x6d, 0x0, 0x1a, 0xff}, color.RGBA{0xbe, 0x0, 0x39, 0xff}, color.RGBA{0xff, 0x45, 0x0, 0xff},
-	color.RGBA{0xff, 0xa8, 0x0, 0xff}, color.RGBA{0xff, 0xd6, 0x35, 0xff}, color.RGBA{0xff, 0xf8, 0xb8, 0xff}, color.RGBA{0x0, 0xa3, 0x68, 0xff},
-	color.RGBA{0x0, 0xcc, 0x78, 0xff}, color.RGBA{0x7e, 0xed, 0x56, 0xff}, color.RGBA{0x0, 0x75, 0x6f, 0xff}, color.RGBA{0x0, 0x9e, 0xaa, 0xff},
-	color.RGBA{0x0, 0xcc, 0xc0, 0xff}, color.RGBA{0x24, 0x50, 0xa4, 0xff}, color.RGBA{0x36, 0x90, 0xea, 0xff}, color.RGBA{0x51, 0xe9, 0xf4, 0xff},
-	color.RGBA{0x49, 0x3a, 0xc1, 0xff}, color.RGBA{0x6a, 0x5c, 0xff, 0xff}, color.RGBA{0x94, 0xb3, 0xff, 0xff}, color.RGBA{0x81, 0x1e, 0x9f, 0xff},
-	color.RGBA{0xb4, 0x4a, 0xc0, 0xff}, color.RGBA{0xe4, 0xab, 0xff, 0xff}, color.RGBA{0xde, 0x10, 0x7f, 0xff}, color.RGBA{0xff, 0x38, 0x81, 0xff},
-	color.RGBA{0xff, 0x99, 0xaa, 0xff}, color.RGBA{0x6d, 0x48, 0x2f, 0xff}, color.RGBA{0x9c, 0x69, 0x26, 0xff}, color.RGBA{0xff, 0xb4, 0x70, 0xff},
-	color.RGBA{0x0, 0x0, 0x0, 0xff}, color.RGBA{0x51, 0x52, 0x52, 0xff}, color.RGBA{0x89, 0x8d, 0x90, 0xff}, color.RGBA{0xd4, 0xd7, 0xd9, 0xff},
-	color.RGBA{0xff, 0xff, 0xff, 0xff},
-}
-
-func (s *server) deltaHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	ts, _ := strconv.Atoi(vars["ts"])
-	quad, _ := strconv.Atoi(vars["quad"])
-
-	e, ok := s.dr.FileMap[quad][ts]
-	if !ok {
-		http.Error(w, "no images found", 404)
-		return
-	}
-
-	s.dr.L.Lock()
-	defer s.dr.L.Unlock()
-	fr, err := e.F.Open()
+	fr, err := e.Open()
 	if err != nil {
 		http.Error(w, err.Error(), 500)
+		return
 	}
 	defer fr.Close()
 	_, err = io.Copy(w, fr)
@@ -192,18 +90,18 @@ func (s *server) deltaHandler(w http.ResponseWriter, r *http.Request) {
 var indexTmpl = template.Must(template.New("index").Parse(`
 <html>
 <head>
-<title>r/Place 2023 Timeline</title>
+<title>r/Place {{.Name}} Timeline</title>
 </head>
 <body style="overflow:hidden;margin:0;background-color:black;color:white;">
 <div style="margin:5px;display:flex;">
-<span id="timestamp"></span>&nbsp;<br>
-<input id="slider" type="range" min="1689858080999" max="1690320892999" value="1689858080999" style="width:100%">
+{{if ne .Prefix "/"}}<a href="../" style="color:white">all</a>&nbsp;{{end}}<span id="timestamp"></span>&nbsp;<br>
+<input id="slider" type="range" min="{{.Start}}" max="{{.End}}" value="{{.Start}}" style="width:100%">
 </div>
 <div style="margin:5px;display:flex;">
 <input id="slider2" type="range" min="-60000" max="60000" value="0" style="width:100%"><br>
 </div>
 <div id="viewport" style="height:100%;user-select:none;overflow:clip">
-<img id="canvas" style="image-rendering:pixelated;touch-action:none" src="full/1689858080999.png" ondragstart="return false">
+<img id="canvas" style="image-rendering:pixelated;touch-action:none" src="full/{{.Start}}.png" ondragstart="return false">
 </div>
 </body>
 <script type="text/javascript">
@@ -237,8 +135,8 @@ function updateTransform() {
 var tx = 0, ty = 0;
 viewport.onmousemove = function(e) {
 	if (e.buttons) {
-		tx = Math.min(2000, Math.max(-3000, tx + e.movementX));
-		ty = Math.min(2000, Math.max(-3000, ty + e.movementY));
+		tx = Math.min({{.Width}}, Math.max(-{{.Width}}, tx + e.movementX));
+		ty = Math.min({{.Height}}, Math.max(-{{.Height}}, ty + e.movementY));
 		console.log(tx, ty);
 		updateTransform();
 	}
@@ -258,90 +156,76 @@ setInterval(function() {
 `))
 
 func (s *server) indexHandler(w http.ResponseWriter, r *http.Request) {
-	err := indexTmpl.Execute(w, nil)
+	err := indexTmpl.Execute(w, struct {
+		*profile.Profile
+		Width, Height int
+		Prefix        string
+	}{s.p, s.p.Width(), s.p.Height(), s.prefix})
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 }
 
-type ColumnarReader struct {
-	f       io.ReaderAt
-	startTs uint64
-	offsets [3000*2000 + 1]uint32
-}
+// GIF delays are in hundredths of a second
+const maxGifDelay = 1000
 
-func MakeColumnarReader(filename string) (*ColumnarReader, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+// parseTime parses a timestamp given in Unix milliseconds or as RFC3339.
+func parseTime(v string) (int64, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return ms, nil
 	}
-
-	buf := make([]byte, 8)
-	f.Read(buf[:8])
-
-	if !reflect.DeepEqual(buf[:8], []byte("COLMPACK")) {
-		log.Fatal("unknown header", buf[:8])
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, err
 	}
+	return t.UnixMilli(), nil
+}
 
-	r := &ColumnarReader{
-		f: f,
+// parseInterval parses a duration given in milliseconds or in Go's duration
+// syntax, such as "30s".
+func parseInterval(v string) (int64, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return ms, nil
 	}
-
-	var o uint32
-	binary.Read(f, binary.LittleEndian, &r.startTs)
-	binary.Read(f, binary.LittleEndian, &o)
-
-	r.offsets[0] = o
-	br := bufio.NewReader(f)
-	for i := 0; i < 3000*2000; i++ {
-		n, err := binary.ReadUvarint(br)
-		if err != nil {
-			return nil, err
-		}
-		o += uint32(n)
-		r.offsets[i+1] = o
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
 	}
-
-	fmt.Println(r.startTs, o, r.offsets[:20])
-
-	return r, nil
-}
-
-type historyEntry uint64
-
-func (h historyEntry) color() uint8 {
-	return uint8(h & 31)
+	return d.Milliseconds(), nil
 }
 
-func (h historyEntry) ts() uint32 {
-	return uint32(h >> 5)
-}
-
-func (h historyEntry) String() string {
-	return fmt.Sprintf("%d:%d", h.ts(), h.color())
-}
-
-func (r *ColumnarReader) GetPixelHistory(x, y int) []historyEntry {
-	if x < 0 || x >= 3000 || y < 0 || y >= 2000 {
-		return nil
+// checkTimelapse validates a timelapse of a width x height area, magnified
+// by scale, over from-to, which must be within start-end. It returns the
+// interval, shortened to fit the time range, and the number of frames.
+func (l gifLimits) checkTimelapse(width, height, scale int, from, to, interval, start, end int64) (int64, int, error) {
+	if width <= 0 || height <= 0 {
+		return 0, 0, errors.New("empty size")
 	}
-	o := x + y*3000
-	buf := make([]byte, r.offsets[o+1]-r.offsets[o])
-	r.f.ReadAt(buf, int64(r.offsets[o]))
-
-	ents := make([]historyEntry, 0, len(buf)/2)
-	for o := 0; o < len(buf); {
-		e, n := binary.Uvarint(buf[o:])
-		if n == 0 {
-			break
-		}
-		//fmt.Println("getpixelhistory", x, y, len(buf), o, e, n)
-		o += n
-		ents = append(ents, historyEntry(e))
+	if scale < 1 || scale > l.MaxScale {
+		return 0, 0, fmt.Errorf("scale must be from 1 to %d", l.MaxScale)
 	}
-
-	return ents
+	// compare by division, since width*height can overflow
+	if maxPixels := l.MaxPixels * scale * scale; width > maxPixels || height > maxPixels/width {
+		return 0, 0, errors.New("too big")
+	}
+	if from < start || to > end {
+		return 0, 0, fmt.Errorf("time range must be within %d-%d", start, end)
+	}
+	if to <= from {
+		return 0, 0, errors.New("to must be after from")
+	}
+	if minInterval := time.Duration(l.MinInterval).Milliseconds(); interval < minInterval {
+		return 0, 0, fmt.Errorf("interval must be at least %dms", minInterval)
+	}
+	if interval > to-from {
+		interval = to - from
+	}
+	frameCount := int((to - from + interval - 1) / interval)
+	if frameCount > l.MaxFrames {
+		return 0, 0, fmt.Errorf("%d frames of %dx%d is too many; use a longer interval or shorter range", frameCount, width, height)
+	}
+	return interval, frameCount, nil
 }
 
 func (s *server) gifHandler(w http.ResponseWriter, r *http.Request) {
@@ -352,226 +236,349 @@ func (s *server) gifHandler(w http.ResponseWriter, r *http.Request) {
 
 	width, _ := strconv.Atoi(vars["w"])
 	height, _ := strconv.Atoi(vars["h"])
-	scale := 1
-	if s, ok := vals["scale"]; ok && len(s) == 1 {
-		scale, _ = strconv.Atoi(s[0])
-		if scale > 4 || scale < 1 {
-			scale = 1
+
+	from, to := int64(s.col.StartTs), int64(s.col.EndTs)
+	interval := int64(60_000)
+	scale, delay := 1, 2
+	var err error
+	if v := vals.Get("scale"); v != "" {
+		// checkTimelapse rejects scales out of range
+		if scale, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "bad scale: "+err.Error(), 400)
+			return
+		}
+	}
+	if v := vals.Get("from"); v != "" {
+		if from, err = parseTime(v); err != nil {
+			http.Error(w, "bad from: "+err.Error(), 400)
+			return
+		}
+	}
+	if v := vals.Get("to"); v != "" {
+		if to, err = parseTime(v); err != nil {
+			http.Error(w, "bad to: "+err.Error(), 400)
+			return
+		}
+	}
+	if v := vals.Get("interval"); v != "" {
+		if interval, err = parseInterval(v); err != nil {
+			http.Error(w, "bad interval: "+err.Error(), 400)
+			return
+		}
+	}
+	if v := vals.Get("delay"); v != "" {
+		if delay, err = strconv.Atoi(v); err != nil || delay < 1 || delay > maxGifDelay {
+			http.Error(w, fmt.Sprintf("delay must be 1-%d hundredths of a second", maxGifDelay), 400)
+			return
 		}
 	}
 
-	if width*height > 600*600*scale*scale {
-		http.Error(w, "too big", 400)
+	interval, frameCount, err := s.gif.checkTimelapse(width, height, scale, from, to, interval, int64(s.col.StartTs), int64(s.col.EndTs))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	interval := uint32(1000 * 37.6 * 1)
-	interval = 1000 * 60 * 1
-	frameCount := 462812000 / int(interval)
-	g := gif.GIF{
-		Image: make([]*image.Paletted, frameCount),
-		Delay: make([]int, frameCount),
-		Config: image.Config{
-			ColorModel: pal,
-			Width:      width,
-			Height:     height,
-		},
-		BackgroundIndex: 0,
-	}
-	nonEmptyFrames := make([]bool, frameCount)
-	fmt.Println("VARS", cx, cy, width, height, frameCount, len(nonEmptyFrames))
-
-	for i := 0; i < frameCount; i++ {
-		g.Image[i] = image.NewPaletted(image.Rect(0, 0, width, height), pal)
-		g.Delay[i] = 2
-	}
-
-	maxTT := uint32(0)
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			hist := s.col.GetPixelHistory(cx-width/2+x, cy-height/2+y)
-			// fmt.Println(x, y, hist)
-			c := uint8(32)
-			maxT := interval
-			i := 0
-			t := uint32(0)
-		histloop:
-			for _, e := range hist {
-				t += e.ts()
-				for t > maxT {
-					g.Image[i].SetColorIndex(x, y, c)
-					if c != 32 {
-						nonEmptyFrames[i] = true
-					}
-					maxT += interval
-					i++
-					if i >= len(g.Image) {
-						break histloop
-					}
-				}
-				c = e.color() + 1
-			}
-			if maxT-interval > maxTT {
-				maxTT = maxT - interval
-			}
+	g := gifParams{
+		cx: cx, cy: cy, width: width, height: height, scale: scale,
+		from: from, interval: interval, frameCount: frameCount, delay: delay,
+	}
+	key := s.renderKey("gif", s.col.ID, fmt.Sprintf("%+v", g))
+	if checkETag(w, r, key) {
+		return
+	}
+	w.Header().Set("content-type", "image/gif")
 
-		}
+	// the gif is streamed out as it's made, so errors can only be reported
+	// before the first write
+	ew := &etagWriter{w: w, key: key}
+	err = s.rc.Stream(ew, key, func(w io.Writer) error {
+		return s.writeGif(w, g, nil)
+	})
+	if err != nil && !ew.wrote {
+		http.Error(w, err.Error(), 500)
+	} else if err != nil {
+		log.Println("writing gif:", err)
 	}
-	fmt.Println("last frame", uint64(maxTT)+s.col.startTs, s.col.startTs)
+}
 
-	// clear early blank white images
-	for i, e := range nonEmptyFrames {
-		if e {
-			g.Image = g.Image[i:]
-			g.Delay = g.Delay[i:]
-			frameCount -= i
-			break
+type gifParams struct {
+	cx, cy, width, height, scale int
+	from, interval               int64
+	frameCount, delay            int
+}
+
+// writeGif renders a timelapse of the pixels around (cx, cy). If progress
+// isn't nil, it's called before each frame, and an error from it stops the
+// rendering.
+func (s *server) writeGif(w io.Writer, g gifParams, progress func(frame, frames int) error) error {
+	gifRenders.Add(1)
+	defer gifRenders.Add(-1)
+	cx, cy, width, height, scale := g.cx, g.cy, g.width, g.height, g.scale
+	from, interval, frameCount, delay := g.from, g.interval, g.frameCount, g.delay
+
+	// Walk every pixel's history in time order. Each pixel waits in the
+	// bucket of the frame its next event lands in, so a frame only touches
+	// the pixels that change in it.
+	n := width * height
+	hists := make([][]byte, n)
+	times := make([]uint32, n)
+	cur := make([]uint8, n)
+	buckets := map[int][]int{}
+	fromOff := uint32(from - int64(s.col.StartTs))
+	iv := uint32(interval)
+	frameOf := func(t uint32) int {
+		if t <= fromOff+iv {
+			return 0
 		}
+		return int((t - fromOff - 1) / iv)
 	}
-
-	for i := frameCount - 1; i > 0; i-- {
-		for j := 0; j < width*height; j++ {
-			if g.Image[i].Pix[j] == g.Image[i-1].Pix[j] {
-				g.Image[i].Pix[j] = 0
+	queue := func(i int) {
+		if e, m := binary.Uvarint(hists[i]); m > 0 {
+			if f := frameOf(times[i] + columnar.HistoryEntry(e).Ts()); f < frameCount {
+				buckets[f] = append(buckets[f], i)
 			}
 		}
 	}
-
-	if scale != 1 {
-		g.Config.Width *= scale
-		g.Config.Height *= scale
-		for i := 0; i < frameCount; i++ {
-			dst := image.NewPaletted(image.Rect(0, 0, width*scale, height*scale), pal)
-			draw.NearestNeighbor.Scale(dst, dst.Rect, g.Image[i], g.Image[i].Bounds(), draw.Over, nil)
-			g.Image[i] = dst
-		}
+	for i := range cur {
+		cur[i] = s.p.Blank
+		hists[i] = s.col.PixelData(cx-width/2+i%width, cy-height/2+i/width)
+		queue(i)
 	}
 
-	for i := 0; i < frameCount; i++ {
-		im := g.Image[i]
+	gw := newGifWriter(w, width*scale, height*scale, s.p.Palette)
 
-		var cropleft, cropright, croptop, cropbottom int
-
-		w := im.Rect.Dx()
-		h := im.Rect.Dy()
+	// frames are held back until the next change, since their delay grows
+	// with every unchanged frame after them. Writes fail once the client is
+	// gone or the write deadline passes, which ends the render.
+	var pending *image.Paletted
+	pendingDelay := 0
+	emit := func(im *image.Paletted) error {
+		var err error
+		if pending != nil {
+			err = gw.WriteFrame(pending, pendingDelay)
+		}
+		pending, pendingDelay = im, delay
+		return err
+	}
 
-	cropleft:
-		for ; cropleft < w; cropleft++ {
-			for y := 0; y < h; y++ {
-				c := im.ColorIndexAt(cropleft, y)
-				if c != 0 {
-					break cropleft
-				}
+	started := false
+	nonBlank := 0
+	for f := 0; f < frameCount; f++ {
+		if progress != nil {
+			if err := progress(f, frameCount); err != nil {
+				return err
 			}
 		}
-	cropright:
-		for cropright = w - 1; cropright > cropleft; cropright-- {
-			for y := 0; y < h; y++ {
-				c := im.ColorIndexAt(cropright, y)
-				if c != 0 {
-					break cropright
+		maxT := fromOff + uint32(f+1)*iv
+		changed := buckets[f][:0]
+		for _, i := range buckets[f] {
+			old := cur[i]
+			h := hists[i]
+			for len(h) > 0 {
+				e, m := binary.Uvarint(h)
+				if m <= 0 {
+					h = nil
+					break
+				}
+				t := times[i] + columnar.HistoryEntry(e).Ts()
+				if t > maxT {
+					break
 				}
+				times[i] = t
+				cur[i] = columnar.HistoryEntry(e).Color() + 1
+				h = h[m:]
 			}
-		}
-	croptop:
-		for ; croptop < h; croptop++ {
-			for x := 0; x < w; x++ {
-				c := im.ColorIndexAt(x, croptop)
-				if c != 0 {
-					break croptop
+			hists[i] = h
+			queue(i)
+			if cur[i] != old {
+				changed = append(changed, i)
+				if old == s.p.Blank {
+					nonBlank++
+				} else if cur[i] == s.p.Blank {
+					nonBlank--
 				}
 			}
 		}
+		delete(buckets, f)
 
-	cropbottom:
-		for cropbottom = h - 1; cropbottom > 0; cropbottom-- {
-			for x := 0; x < w; x++ {
-				c := im.ColorIndexAt(x, cropbottom)
-				if c != 0 {
-					break cropbottom
+		// leading frames of untouched canvas are dropped
+		if !started {
+			if nonBlank == 0 {
+				continue
+			}
+			started = true
+			if err := emit(scaleFrame(cur, image.Rect(0, 0, width, height), width, scale, s.p.Palette, nil)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(changed) == 0 {
+			if pendingDelay+delay > 0xffff {
+				// too long for one frame, so continue it with an empty one
+				if err := emit(image.NewPaletted(image.Rect(0, 0, 1, 1), s.p.Palette)); err != nil {
+					return err
 				}
+			} else {
+				pendingDelay += delay
 			}
+			continue
 		}
 
-		g.Image[i] = im.SubImage(image.Rect(cropleft, croptop, cropright+1, cropbottom+1)).(*image.Paletted)
+		var crop image.Rectangle
+		for _, i := range changed {
+			crop = crop.Union(image.Rect(i%width, i/width, i%width+1, i/width+1))
+		}
+		if err := emit(scaleFrame(cur, crop, width, scale, s.p.Palette, changed)); err != nil {
+			return err
+		}
+	}
+
+	if !started {
+		pending, pendingDelay = scaleFrame(cur, image.Rect(0, 0, width, height), width, scale, s.p.Palette, nil), delay
+	}
+	if err := gw.WriteFrame(pending, pendingDelay); err != nil {
+		return err
 	}
+	return gw.Close()
+}
 
-	// coalesce empty frames into previous ones
-	empty := 0
-	for i := len(g.Image) - 1; i > 0; i-- {
-		if g.Image[i].Rect.Dx() == 0 {
-			g.Delay[i-1] += g.Delay[i]
-			empty++
-			// this is the simple O(N^2) way to do the coalesce
-			copy(g.Image[i:], g.Image[i+1:])
-			copy(g.Delay[i:], g.Delay[i+1:])
-			g.Image = g.Image[:len(g.Image)-1]
-			g.Delay = g.Delay[:len(g.Delay)-1]
+// scaleFrame builds a GIF frame of rect r of the w-wide image pix, scaled
+// up. Only the pixels listed in only are drawn, leaving the rest transparent,
+// unless only is nil.
+func scaleFrame(pix []uint8, r image.Rectangle, w, scale int, pal color.Palette, only []int) *image.Paletted {
+	im := image.NewPaletted(image.Rect(r.Min.X*scale, r.Min.Y*scale, r.Max.X*scale, r.Max.Y*scale), pal)
+	set := func(i int) {
+		x, y := i%w*scale, i/w*scale
+		for dy := 0; dy < scale; dy++ {
+			o := im.PixOffset(x, y+dy)
+			for dx := 0; dx < scale; dx++ {
+				im.Pix[o+dx] = pix[i]
+			}
 		}
 	}
-	if empty > 0 {
-		fmt.Println("removed", empty, "empty frames")
+	if only != nil {
+		for _, i := range only {
+			set(i)
+		}
+		return im
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			set(x + y*w)
+		}
 	}
+	return im
+}
 
-	gif.EncodeAll(w, &g)
+// renderKey names a rendering of the dataset.
+func (s *server) renderKey(kind string, parts ...string) string {
+	return renderKey(kind, append([]string{s.name}, parts...)...)
 }
 
 func main() {
+	configFile := flag.String("config", "", "JSON config file, reloaded on SIGHUP; replaces every other flag")
 	dataDir := flag.String("datadir", ".", "directory holding canvas zips")
 	port := flag.Int("port", 9999, "port number to listen on")
 	column := flag.String("column", "", "columnar datafile to generate gifs from")
+	profileName := flag.String("profile", profile.Default, "canvas profile: 2017, 2022 or 2023")
+	cacheMB := flag.Int("cachemb", delta.DefaultCacheBytes>>20, "size of each dataset's decoded frame cache in MiB")
+	eventFiles := flag.String("events", "", "comma-separated PIXELPAK or PIXLPACK files or globs to replay, in order")
+	renderDir := flag.String("rendercache", "", "directory to keep rendered images in")
+	renderMB := flag.Int("rendercachemb", 1024, "size limit of the -rendercache directory in MiB")
+	jobDir := flag.String("jobdir", "", "directory to keep the results of render jobs in; jobs are disabled without it")
+	frames := flag.String("frames", "", "comma-separated canvas zips, tars, PNG directories or globs to load instead of the zips in -datadir")
+	var datasets datasetFlags
+	flag.Var(&datasets, "dataset", "serve a dataset under /name/, given as name:key=value;... with keys profile, datadir, frames, column, events, start and end (repeatable; replaces -datadir, -frames, -column, -events and -profile)")
 	flag.Parse()
 
-	fname := filepath.Join(*dataDir, "canvas_full.zip")
-	dname := filepath.Join(*dataDir, "canvas_delta.zip")
-	tname := filepath.Join(*dataDir, "canvas_ticks.zip")
-	if _, err := os.Stat(dname); err != nil && !os.IsNotExist(err) {
-		dname = ""
-		tname = ""
+	cfg := defaultConfig()
+	var err error
+	if *configFile != "" {
+		if cfg, err = readConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
 	} else {
-		if _, err := os.Stat(tname); err != nil && os.IsNotExist(err) {
-			tname = ""
+		if len(datasets) == 0 {
+			datasets = append(datasets, dataset{
+				Profile: *profileName,
+				DataDir: *dataDir,
+				Frames:  *frames,
+				Column:  *column,
+				Events:  *eventFiles,
+			})
 		}
+		cfg.Listen = []string{fmt.Sprintf("127.0.0.1:%d", *port)}
+		cfg.FrameCacheMB = *cacheMB
+		cfg.RenderCache = *renderDir
+		cfg.RenderCacheMB = *renderMB
+		cfg.Jobs.Dir = *jobDir
+		cfg.Datasets = datasets
 	}
 
-	log.Println(fname, dname, tname)
-
-	dr, err := delta.MakeDeltaReader(fname, dname, tname)
+	a, err := build(cfg, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
+	var cur atomic.Pointer[app]
+	cur.Store(a)
 
-	var col *ColumnarReader
-
-	if *column != "" {
-		col, err = MakeColumnarReader(*column)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a retired app was just replaced, so the next load gets the new one
+			for !cur.Load().serve(w, r) {
+			}
+		}),
+		// the app sets the default write deadline, and routes their own
+		ReadTimeout: time.Duration(cfg.ReadTimeout),
+	}
+	for _, addr := range cfg.Listen {
+		l, err := listen(addr)
 		if err != nil {
 			log.Fatal(err)
 		}
+		log.Println("listening on", addr)
+		go func() {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
 	}
 
-	r := mux.NewRouter()
-	s := &server{
-		dr:  dr,
-		col: col,
-	}
-
-	r.HandleFunc("/", s.indexHandler)
-	r.HandleFunc("/full/{ts:[0-9]+}.png", s.fullHandler)
-	r.HandleFunc("/delta/{quad:[0-3]}/{ts:[0-9]+}.png", s.deltaHandler)
-	if col != nil {
-		r.HandleFunc("/gif/{x:[0-9]+}_{y:[0-9]+}-{w:[0-9]+}x{h:[0-9]+}.gif", s.gifHandler)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if *configFile == "" {
+			log.Println("SIGHUP: no -config file to reload")
+			continue
+		}
+		next, err := readConfig(*configFile)
+		if err != nil {
+			log.Println("reloading config:", err)
+			continue
+		}
+		if !reflect.DeepEqual(next.Listen, cfg.Listen) || next.ReadTimeout != cfg.ReadTimeout || next.Jobs != cfg.Jobs {
+			log.Println("listen addresses, read timeouts and job settings only change on restart")
+		}
+		a, err := build(next, cur.Load())
+		if err != nil {
+			log.Println("reloading config:", err)
+			continue
+		}
+		cur.Swap(a).retire()
+		log.Println("reloaded", *configFile)
 	}
 
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         fmt.Sprintf("127.0.0.1:%d", *port),
-		WriteTimeout: 10 * time.Second,
-		ReadTimeout:  10 * time.Second,
+	log.Println("shutting down")
+	stop()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cur.Load().cfg.ShutdownTimeout))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+		srv.Close()
 	}
-
-	log.Println("listening on", srv.Addr)
-
-	log.Fatal(srv.ListenAndServe())
 }
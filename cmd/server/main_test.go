@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/columnar"
+)
+
+func TestCheckTimelapse(t *testing.T) {
+	s := &server{gif: gifLimits{MaxFrames: 100, MaxPixels: 100, MaxScale: 4, MinInterval: duration(time.Second)}}
+	for _, tc := range []struct {
+		name               string
+		w, h, scale        int
+		from, to, interval int64
+		wantInterval       int64
+		wantFrames         int
+		ok                 bool
+	}{
+		{"ok", 10, 10, 1, 0, 60_000, 1000, 1000, 60, true},
+		{"partial last frame", 10, 10, 1, 0, 60_500, 1000, 1000, 61, true},
+		{"interval past the range", 10, 10, 1, 0, 5000, 60_000, 5000, 1, true},
+		{"scale grows the area", 20, 20, 2, 0, 60_000, 1000, 1000, 60, true},
+		{"empty", 0, 10, 1, 0, 60_000, 1000, 0, 0, false},
+		{"too big", 11, 10, 1, 0, 60_000, 1000, 0, 0, false},
+		{"scale too big", 1, 1, 5, 0, 60_000, 1000, 0, 0, false},
+		{"scale too small", 1, 1, 0, 0, 60_000, 1000, 0, 0, false},
+		// these multiply out to 0 or a small number
+		{"overflowing area", 1 << 32, 1 << 32, 1, 0, 60_000, 1000, 0, 0, false},
+		{"overflowing side", math.MaxInt, 1, 1, 0, 60_000, 1000, 0, 0, false},
+		{"before start", 10, 10, 1, -1, 60_000, 1000, 0, 0, false},
+		{"after end", 10, 10, 1, 0, 200_001, 1000, 0, 0, false},
+		{"backwards", 10, 10, 1, 60_000, 0, 1000, 0, 0, false},
+		{"short interval", 10, 10, 1, 0, 60_000, 999, 0, 0, false},
+		{"too many frames", 10, 10, 1, 0, 100_001, 1000, 0, 0, false},
+	} {
+		interval, frames, err := s.gif.checkTimelapse(tc.w, tc.h, tc.scale, tc.from, tc.to, tc.interval, 0, 200_000)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok %v", tc.name, err, tc.ok)
+			continue
+		}
+		if interval != tc.wantInterval || frames != tc.wantFrames {
+			t.Errorf("%s: interval %d and %d frames, want %d and %d", tc.name, interval, frames, tc.wantInterval, tc.wantFrames)
+		}
+	}
+}
+
+func TestGifHandlerScale(t *testing.T) {
+	s := &server{
+		gif: gifLimits{MaxFrames: 100, MaxPixels: 100, MaxScale: 4, MinInterval: duration(time.Second)},
+		col: &columnar.ColumnarReader{StartTs: 0, EndTs: 60_000, Width: 10, Height: 10},
+	}
+	for _, tc := range []struct {
+		scale, err string
+	}{
+		{"abc", "bad scale"},
+		{"99", "scale must be"},
+		{"0", "scale must be"},
+		{"-1", "scale must be"},
+	} {
+		r := httptest.NewRequest("GET", "/gif/5_5-4x4.gif?scale="+tc.scale, nil)
+		r = mux.SetURLVars(r, map[string]string{"x": "5", "y": "5", "w": "4", "h": "4"})
+		w := httptest.NewRecorder()
+		s.gifHandler(w, r)
+		if w.Code != 400 || !strings.Contains(w.Body.String(), tc.err) {
+			t.Errorf("scale %s: %d %q, want 400 with %q", tc.scale, w.Code, w.Body.String(), tc.err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rmmh/rplace/delta"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type routeKey struct {
+	Dataset, Route string
+}
+
+type routeStats struct {
+	// Codes counts responses by status code.
+	Codes map[int]int64
+	// Buckets counts requests taking at most each latency bucket.
+	Buckets []int64
+	Count   int64
+	Seconds float64
+}
+
+// requestMetrics tracks the requests to each route of each dataset.
+type requestMetrics struct {
+	mu     sync.Mutex
+	routes map[routeKey]*routeStats
+}
+
+var metrics = &requestMetrics{routes: make(map[routeKey]*routeStats)}
+
+// gifRenders counts the GIFs being rendered.
+var gifRenders atomic.Int64
+
+func (m *requestMetrics) observe(k routeKey, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rs := m.routes[k]
+	if rs == nil {
+		rs = &routeStats{Codes: make(map[int]int64), Buckets: make([]int64, len(latencyBuckets))}
+		m.routes[k] = rs
+	}
+	rs.Codes[code]++
+	rs.Count++
+	rs.Seconds += d.Seconds()
+	for i, b := range latencyBuckets {
+		if d.Seconds() <= b {
+			rs.Buckets[i]++
+		}
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = 200
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument records the count, status and latency of a route's requests,
+// and bounds how long they may take to write.
+func (s *server) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	k := routeKey{s.name, route}
+	timeout := s.timeout(route)
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// replace the app's default deadline, or clear it for no timeout
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = start.Add(timeout)
+		}
+		http.NewResponseController(w).SetWriteDeadline(deadline)
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r)
+		if rec.code == 0 {
+			rec.code = 200
+		}
+		metrics.observe(k, rec.code, time.Since(start))
+	}
+}
+
+type timingStats struct {
+	Count   int64   `json:"count"`
+	Seconds float64 `json:"seconds"`
+}
+
+func makeTimingStats(t *delta.Timing) timingStats {
+	return timingStats{t.Count(), t.Total().Seconds()}
+}
+
+type datasetStats struct {
+	Name        string           `json:"name"`
+	FrameCache  delta.CacheStats `json:"frameCache"`
+	ColumnBytes int64            `json:"columnBytesRead"`
+}
+
+type routeSnapshot struct {
+	Dataset string           `json:"dataset"`
+	Route   string           `json:"route"`
+	Count   int64            `json:"count"`
+	Seconds float64          `json:"seconds"`
+	Codes   map[string]int64 `json:"codes"`
+	Buckets []int64          `json:"-"`
+}
+
+type stats struct {
+	Routes     []routeSnapshot `json:"routes"`
+	Datasets   []datasetStats  `json:"datasets"`
+	Decode     timingStats     `json:"decode"`
+	Apply      timingStats     `json:"apply"`
+	FrameBytes int64           `json:"frameBytesRead"`
+	GifRenders int64           `json:"gifRenders"`
+}
+
+// snapshot gathers every metric, with routes and datasets in a stable order.
+func snapshot(servers []*server) stats {
+	st := stats{
+		Routes:     []routeSnapshot{},
+		Datasets:   []datasetStats{},
+		Decode:     makeTimingStats(&delta.DecodeTime),
+		Apply:      makeTimingStats(&delta.ApplyTime),
+		FrameBytes: delta.BytesRead.Load(),
+		GifRenders: gifRenders.Load(),
+	}
+	metrics.mu.Lock()
+	for k, rs := range metrics.routes {
+		codes := make(map[string]int64)
+		for c, n := range rs.Codes {
+			codes[fmt.Sprint(c)] = n
+		}
+		st.Routes = append(st.Routes, routeSnapshot{
+			k.Dataset, k.Route, rs.Count, rs.Seconds, codes, append([]int64(nil), rs.Buckets...),
+		})
+	}
+	metrics.mu.Unlock()
+	sort.Slice(st.Routes, func(i, j int) bool {
+		a, b := st.Routes[i], st.Routes[j]
+		if a.Dataset != b.Dataset {
+			return a.Dataset < b.Dataset
+		}
+		return a.Route < b.Route
+	})
+	for _, s := range servers {
+		ds := datasetStats{Name: s.name, FrameCache: s.dr.CacheStats()}
+		if s.col != nil {
+			ds.ColumnBytes = s.col.BytesRead()
+		}
+		st.Datasets = append(st.Datasets, ds)
+	}
+	return st
+}
+
+// labelEscaper escapes label values as the Prometheus text format expects,
+// which unlike Go quoting leaves every other character as is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label quotes a label value.
+func label(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(servers []*server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := snapshot(servers)
+		w.Header().Set("content-type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		defer bw.Flush()
+
+		metric := func(name, typ, help string) {
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		}
+
+		metric("rplace_requests_total", "counter", "Requests served, by dataset, route and status code.")
+		for _, rs := range st.Routes {
+			codes := make([]string, 0, len(rs.Codes))
+			for c := range rs.Codes {
+				codes = append(codes, c)
+			}
+			sort.Strings(codes)
+			for _, c := range codes {
+				fmt.Fprintf(bw, "rplace_requests_total{dataset=%s,route=%s,code=%s} %d\n", label(rs.Dataset), label(rs.Route), label(c), rs.Codes[c])
+			}
+		}
+		metric("rplace_request_duration_seconds", "histogram", "Time taken to serve requests, by dataset and route.")
+		for _, rs := range st.Routes {
+			labels := fmt.Sprintf("dataset=%s,route=%s", label(rs.Dataset), label(rs.Route))
+			for i, b := range latencyBuckets {
+				fmt.Fprintf(bw, "rplace_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, b, rs.Buckets[i])
+			}
+			fmt.Fprintf(bw, "rplace_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, rs.Count)
+			fmt.Fprintf(bw, "rplace_request_duration_seconds_sum{%s} %g\n", labels, rs.Seconds)
+			fmt.Fprintf(bw, "rplace_request_duration_seconds_count{%s} %d\n", labels, rs.Count)
+		}
+
+		for _, m := range []struct {
+			name, typ, help string
+			value           func(c delta.CacheStats) int64
+		}{
+			{"rplace_frame_cache_hits_total", "counter", "Frame cache lookups that found the frame.", func(c delta.CacheStats) int64 { return c.Hits }},
+			{"rplace_frame_cache_misses_total", "counter", "Frame cache lookups that loaded the frame.", func(c delta.CacheStats) int64 { return c.Misses }},
+			{"rplace_frame_cache_shared_total", "counter", "Frame cache lookups that waited on another's load.", func(c delta.CacheStats) int64 { return c.Shared }},
+			{"rplace_frame_cache_evictions_total", "counter", "Frames evicted from the frame cache.", func(c delta.CacheStats) int64 { return c.Evictions }},
+			{"rplace_frame_cache_entries", "gauge", "Frames in the frame cache.", func(c delta.CacheStats) int64 { return int64(c.Entries) }},
+			{"rplace_frame_cache_bytes", "gauge", "Size of the frames in the frame cache.", func(c delta.CacheStats) int64 { return c.Bytes }},
+		} {
+			metric(m.name, m.typ, m.help)
+			for _, ds := range st.Datasets {
+				fmt.Fprintf(bw, "%s{dataset=%s} %d\n", m.name, label(ds.Name), m.value(ds.FrameCache))
+			}
+		}
+		metric("rplace_column_read_bytes_total", "counter", "Bytes read from columnar files.")
+		for _, ds := range st.Datasets {
+			fmt.Fprintf(bw, "rplace_column_read_bytes_total{dataset=%s} %d\n", label(ds.Name), ds.ColumnBytes)
+		}
+
+		metric("rplace_frame_decode_seconds", "summary", "Time spent decoding stored frames.")
+		fmt.Fprintf(bw, "rplace_frame_decode_seconds_sum %g\nrplace_frame_decode_seconds_count %d\n", st.Decode.Seconds, st.Decode.Count)
+		metric("rplace_delta_apply_seconds", "summary", "Time spent applying deltas to their base frames.")
+		fmt.Fprintf(bw, "rplace_delta_apply_seconds_sum %g\nrplace_delta_apply_seconds_count %d\n", st.Apply.Seconds, st.Apply.Count)
+		metric("rplace_frame_read_bytes_total", "counter", "Undecoded bytes read from frame archives.")
+		fmt.Fprintf(bw, "rplace_frame_read_bytes_total %d\n", st.FrameBytes)
+		metric("rplace_gif_renders", "gauge", "GIFs being rendered.")
+		fmt.Fprintf(bw, "rplace_gif_renders %d\n", st.GifRenders)
+	}
+}
+
+// statsHandler serves the metrics as JSON.
+func statsHandler(servers []*server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(snapshot(servers))
+	}
+}
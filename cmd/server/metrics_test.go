@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabel(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"plain", `"plain"`},
+		{`a\b`, `"a\\b"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"two\nlines", `"two\nlines"`},
+		// Go quoting would escape these, which Prometheus doesn't undo
+		{"tab\there", "\"tab\there\""},
+		{"café ☃", `"café ☃"`},
+	} {
+		if got := label(tc.in); got != tc.want {
+			t.Errorf("label(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMetricsHandlerLabels(t *testing.T) {
+	metrics.observe(routeKey{"café", "x\"y"}, 200, time.Millisecond)
+	w := httptest.NewRecorder()
+	metricsHandler(nil)(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`rplace_requests_total{dataset="café",route="x\"y",code="200"} 1`,
+		`rplace_request_duration_seconds_count{dataset="café",route="x\"y"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("metrics missing %s:\n%s", want, w.Body)
+		}
+	}
+}
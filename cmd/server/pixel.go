@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxBulkPixels bounds the rectangle a single /pixels request may cover.
+const maxBulkPixels = 100 * 100
+
+type pixelChange struct {
+	Ts    int64  `json:"ts"`
+	Color uint8  `json:"color"`
+	Hex   string `json:"hex"`
+}
+
+type pixelHistory struct {
+	// Palette is only set on single pixel responses; bulk responses give it
+	// once for every pixel.
+	Palette string        `json:"palette,omitempty"`
+	X       int           `json:"x"`
+	Y       int           `json:"y"`
+	Changes []pixelChange `json:"changes"`
+}
+
+// pixelHistory returns the changes to a pixel with from <= ts <= to, with
+// absolute timestamps and profile palette indexes.
+func (s *server) pixelHistory(x, y int, from, to int64) pixelHistory {
+	h := pixelHistory{X: x, Y: y, Changes: []pixelChange{}}
+	ts := int64(s.col.StartTs)
+	for _, e := range s.col.GetPixelHistory(x, y) {
+		ts += int64(e.Ts())
+		if ts > to {
+			break
+		}
+		if ts >= from {
+			c := e.Color() + 1
+			h.Changes = append(h.Changes, pixelChange{Ts: ts, Color: c, Hex: s.p.Pal.Hex(c)})
+		}
+	}
+	return h
+}
+
+// timeRange parses the optional from and to query parameters.
+func timeRange(r *http.Request) (int64, int64, error) {
+	vals := r.URL.Query()
+	from, to := int64(0), int64(1<<62)
+	var err error
+	if v := vals.Get("from"); v != "" {
+		if from, err = parseTime(v); err != nil {
+			return 0, 0, fmt.Errorf("bad from: %w", err)
+		}
+	}
+	if v := vals.Get("to"); v != "" {
+		if to, err = parseTime(v); err != nil {
+			return 0, 0, fmt.Errorf("bad to: %w", err)
+		}
+	}
+	return from, to, nil
+}
+
+// writePixelHistories streams the histories of the w x h rectangle at (x, y)
+// as JSON or CSV.
+func (s *server) writePixelHistories(rw http.ResponseWriter, r *http.Request, x, y, w, h int, single bool) {
+	from, to, err := timeRange(r)
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	if x < 0 || y < 0 || x+w > s.p.Width() || y+h > s.p.Height() {
+		http.Error(rw, "outside the canvas", 404)
+		return
+	}
+
+	bw := bufio.NewWriter(rw)
+	defer bw.Flush()
+
+	switch mux.Vars(r)["format"] {
+	case "json":
+		rw.Header().Set("content-type", "application/json")
+		enc := json.NewEncoder(bw)
+		if single {
+			ph := s.pixelHistory(x, y, from, to)
+			ph.Palette = s.p.Pal.Name
+			enc.Encode(ph)
+			return
+		}
+		fmt.Fprintf(bw, `{"palette":%q,"pixels":[`, s.p.Pal.Name)
+		for py := y; py < y+h; py++ {
+			for px := x; px < x+w; px++ {
+				if px != x || py != y {
+					bw.WriteByte(',')
+				}
+				enc.Encode(s.pixelHistory(px, py, from, to))
+			}
+		}
+		bw.WriteString("]}\n")
+	case "csv":
+		rw.Header().Set("content-type", "text/csv")
+		bw.WriteString("timestamp_millis,color,x,y,index\n")
+		for py := y; py < y+h; py++ {
+			for px := x; px < x+w; px++ {
+				for _, c := range s.pixelHistory(px, py, from, to).Changes {
+					fmt.Fprintf(bw, "%d,%s,%d,%d,%d\n", c.Ts, c.Hex, px, py, c.Color)
+				}
+			}
+		}
+	}
+}
+
+func (s *server) pixelHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+	s.writePixelHistories(w, r, x, y, 1, 1, true)
+}
+
+func (s *server) pixelsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+	width, _ := strconv.Atoi(vars["w"])
+	height, _ := strconv.Atoi(vars["h"])
+	if width <= 0 || height <= 0 {
+		http.Error(w, "empty size", 400)
+		return
+	}
+	if width > maxBulkPixels || height > maxBulkPixels || width*height > maxBulkPixels {
+		http.Error(w, fmt.Sprintf("at most %d pixels per request", maxBulkPixels), 400)
+		return
+	}
+	s.writePixelHistories(w, r, x, y, width, height, false)
+}
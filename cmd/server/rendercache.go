@@ -0,0 +1,356 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// renderKey hashes everything a rendering depends on into a name usable as
+// both an ETag and a cache file name.
+func renderKey(kind string, parts ...string) string {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return kind + "-" + hex.EncodeToString(h.Sum(nil))[:24]
+}
+
+// renderFileName matches the names renderKey gives cache files and their
+// temporary files, so the cache leaves anything else in its directory alone.
+var renderFileName = regexp.MustCompile(`^[a-z]+-[0-9a-f]{24}(\.tmp)?$`)
+
+var errRenderPanicked = errors.New("render panicked")
+
+// checkETag reports whether the client already has the rendering for key,
+// in which case it has been sent a 304.
+func checkETag(w http.ResponseWriter, r *http.Request, key string) bool {
+	etag := `"` + key + `"`
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			w.Header().Set("etag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// setETag sets the ETag header for key. It's only set once the rendering
+// has succeeded, so that errors don't carry a validator.
+func setETag(w http.ResponseWriter, key string) {
+	w.Header().Set("etag", `"`+key+`"`)
+}
+
+// etagWriter sets the ETag header just before the first write of a streamed
+// rendering, so one failing before it writes anything can still send an
+// error without it.
+type etagWriter struct {
+	w     http.ResponseWriter
+	key   string
+	wrote bool
+}
+
+func (e *etagWriter) Write(p []byte) (int, error) {
+	if !e.wrote {
+		setETag(e.w, e.key)
+		e.wrote = true
+	}
+	return e.w.Write(p)
+}
+
+// renderCache keeps rendered images, so concurrent requests for the same
+// render wait for one rendering, and, if it has a directory, finished
+// renders are kept on disk up to a size limit, evicting the least recently
+// used.
+type renderCache struct {
+	dir   string
+	limit int64
+
+	mu     sync.Mutex
+	lru    *list.List // of *renderFile, most recently used first
+	files  map[string]*list.Element
+	size   int64
+	flight map[string]*renderCall
+}
+
+type renderFile struct {
+	key  string
+	size int64
+}
+
+type renderCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+func newRenderCache(dir string, limit int64) (*renderCache, error) {
+	c := &renderCache{
+		dir:    dir,
+		limit:  limit,
+		lru:    list.New(),
+		files:  make(map[string]*list.Element),
+		flight: make(map[string]*renderCall),
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		key   string
+		size  int64
+		mtime time.Time
+	}
+	var fs []found
+	for _, e := range ents {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !renderFileName.MatchString(e.Name()) {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		fs = append(fs, found{e.Name(), info.Size(), info.ModTime()})
+	}
+	// files are touched when used, so the newest go to the front
+	sort.Slice(fs, func(i, j int) bool { return fs[i].mtime.Before(fs[j].mtime) })
+	for _, f := range fs {
+		c.files[f.key] = c.lru.PushFront(&renderFile{f.key, f.size})
+		c.size += f.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Get returns the rendering for key, calling render if it isn't cached and
+// no other request is already rendering it. A rendering cancelled along with
+// its request's context is retried by the requests that waited on it.
+func (c *renderCache) Get(key string, render func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	for {
+		call, ok := c.flight[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		call.wg.Wait()
+		if !errors.Is(call.err, context.Canceled) && !errors.Is(call.err, context.DeadlineExceeded) {
+			return call.data, call.err
+		}
+		c.mu.Lock()
+	}
+	call := c.start(key)
+	defer c.finish(key, call)
+
+	call.data, call.err = c.load(key, render)
+	return call.data, call.err
+}
+
+// start marks key as being rendered. The lock must be held on entry, and is
+// released.
+func (c *renderCache) start(key string) *renderCall {
+	call := &renderCall{err: errRenderPanicked}
+	call.wg.Add(1)
+	c.flight[key] = call
+	c.mu.Unlock()
+	return call
+}
+
+// finish wakes the requests waiting on key's rendering. It's deferred, so a
+// render that panics doesn't leave them waiting forever.
+func (c *renderCache) finish(key string, call *renderCall) {
+	c.mu.Lock()
+	delete(c.flight, key)
+	c.mu.Unlock()
+	call.wg.Done()
+}
+
+// onDisk reports whether key's rendering is kept on disk.
+func (c *renderCache) onDisk(key string) bool {
+	return c.dir != "" && renderFileName.MatchString(key) && !strings.HasSuffix(key, ".tmp")
+}
+
+func (c *renderCache) load(key string, render func() ([]byte, error)) ([]byte, error) {
+	if !c.onDisk(key) {
+		return render()
+	}
+	path := filepath.Join(c.dir, key)
+
+	c.mu.Lock()
+	el, ok := c.files[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if ok {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return data, nil
+		}
+		c.mu.Lock()
+		c.remove(key)
+		c.mu.Unlock()
+	}
+
+	data, err := render()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Println("render cache:", err)
+		os.Remove(tmp)
+		return data, nil
+	}
+	c.add(key, int64(len(data)))
+	return data, nil
+}
+
+// Stream writes the rendering for key to w. Unlike Get, an uncached
+// rendering is written to w as it's made, and teed into the cache, so it
+// never has to fit in memory. Requests for a key being rendered wait for it
+// to finish, then read it from the cache, or render it themselves if it
+// failed. A failed write to w stops the rendering, as no one would see the
+// rest of it.
+func (c *renderCache) Stream(w io.Writer, key string, render func(io.Writer) error) error {
+	if !c.onDisk(key) {
+		return render(w)
+	}
+	path := filepath.Join(c.dir, key)
+	for {
+		c.mu.Lock()
+		if el, ok := c.files[key]; ok {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			f, err := os.Open(path)
+			if err != nil {
+				c.mu.Lock()
+				c.remove(key)
+				c.mu.Unlock()
+				continue
+			}
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			_, err = io.Copy(w, f)
+			f.Close()
+			return err
+		}
+		if call, ok := c.flight[key]; ok {
+			c.mu.Unlock()
+			call.wg.Wait()
+			continue
+		}
+		call := c.start(key)
+		defer c.finish(key, call)
+		call.err = c.streamRender(w, key, render)
+		return call.err
+	}
+}
+
+// teeWriter writes to w, and to f until writing to f fails.
+type teeWriter struct {
+	w    io.Writer
+	f    *os.File
+	n    int64
+	ferr error
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if t.ferr == nil {
+		var fn int
+		fn, t.ferr = t.f.Write(p[:n])
+		t.n += int64(fn)
+	}
+	return n, err
+}
+
+func (c *renderCache) streamRender(w io.Writer, key string, render func(io.Writer) error) error {
+	path := filepath.Join(c.dir, key)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Println("render cache:", err)
+		return render(w)
+	}
+	t := &teeWriter{w: w, f: f}
+	err = render(t)
+	if cerr := f.Close(); t.ferr == nil {
+		t.ferr = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if t.ferr == nil {
+		t.ferr = os.Rename(tmp, path)
+	}
+	if t.ferr != nil {
+		log.Println("render cache:", t.ferr)
+		os.Remove(tmp)
+		return nil
+	}
+	c.add(key, t.n)
+	return nil
+}
+
+// add records a file written for key.
+func (c *renderCache) add(key string, size int64) {
+	c.mu.Lock()
+	c.remove(key)
+	c.files[key] = c.lru.PushFront(&renderFile{key, size})
+	c.size += size
+	c.evict()
+	c.mu.Unlock()
+}
+
+// lock must be held
+func (c *renderCache) remove(key string) {
+	if el, ok := c.files[key]; ok {
+		c.size -= el.Value.(*renderFile).size
+		c.lru.Remove(el)
+		delete(c.files, key)
+	}
+}
+
+// lock must be held
+func (c *renderCache) evict() {
+	for c.size > c.limit && c.lru.Len() > 0 {
+		f := c.lru.Back().Value.(*renderFile)
+		c.remove(f.key)
+		if renderFileName.MatchString(f.key) {
+			os.Remove(filepath.Join(c.dir, f.key))
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenderCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	stale := renderKey("gif", "stale")
+	files := map[string]bool{
+		"notes.txt":       true,
+		"notes.txt.tmp":   true,
+		stale + ".tmp":    false,
+		renderKey("full"): true,
+	}
+	for name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("12345"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := newRenderCache(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.size != 5 || c.lru.Len() != 1 {
+		t.Errorf("found %d files of %d bytes, want only the rendering", c.lru.Len(), c.size)
+	}
+
+	// rendering more than fits evicts the old rendering, and nothing else
+	key := renderKey("gif", "new")
+	if _, err := c.Get(key, func() ([]byte, error) { return []byte("abcdef"), nil }); err != nil {
+		t.Fatal(err)
+	}
+	files[renderKey("full")] = false
+	files[key] = true
+	for name, keep := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != keep {
+			t.Errorf("%s: stat err %v, want kept %v", name, err, keep)
+		}
+	}
+
+	// renderings survive restarts
+	c, err = newRenderCache(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.Get(key, func() ([]byte, error) { return nil, errors.New("rendered again") })
+	if err != nil || string(data) != "abcdef" {
+		t.Errorf("Get after restart = %q, %v", data, err)
+	}
+}
+
+func TestRenderCacheShared(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		c, err := newRenderCache(dir, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var renders atomic.Int32
+		release := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := c.Get(renderKey("age"), func() ([]byte, error) {
+					renders.Add(1)
+					<-release
+					return []byte("png"), nil
+				})
+				if err != nil || string(data) != "png" {
+					t.Errorf("Get = %q, %v", data, err)
+				}
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		if n := renders.Load(); n != 1 {
+			t.Errorf("dir %q: rendered %d times", dir, n)
+		}
+	}
+}
+
+func TestRenderCachePanic(t *testing.T) {
+	c, err := newRenderCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := renderKey("diff")
+	func() {
+		defer func() { recover() }()
+		c.Get(key, func() ([]byte, error) { panic("render bug") })
+	}()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if data, err := c.Get(key, func() ([]byte, error) { return []byte("ok"), nil }); err != nil || string(data) != "ok" {
+			t.Errorf("Get after a panic = %q, %v", data, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get hung after a render panicked")
+	}
+}
+
+func TestRenderCacheCancelled(t *testing.T) {
+	c, err := newRenderCache("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := renderKey("age")
+	started := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.Get(key, func() ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the first request going away doesn't fail this one
+		data, err := c.Get(key, func() ([]byte, error) { return []byte("ok"), nil })
+		if err != nil || string(data) != "ok" {
+			t.Errorf("Get after a cancelled render = %q, %v", data, err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestRenderCacheStream(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newRenderCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := renderKey("gif")
+	var renders int
+	render := func(w io.Writer) error {
+		renders++
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write([]byte("frame")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// a client that goes away stops the rendering, which isn't kept
+	if err := c.Stream(&failWriter{n: 7}, key, render); !errors.Is(err, errClientGone) {
+		t.Errorf("Stream to a failing writer = %v", err)
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+		t.Errorf("kept %d files from a failed render", len(ents))
+	}
+
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if err := c.Stream(&buf, key, render); err != nil || buf.String() != "frameframeframe" {
+			t.Errorf("Stream %d wrote %q, %v", i, buf.String(), err)
+		}
+	}
+	if renders != 2 {
+		t.Errorf("rendered %d times, want the failed render and one more", renders)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, key)); err != nil || string(b) != "frameframeframe" || c.size != 15 {
+		t.Errorf("cached %q of size %d, %v", b, c.size, err)
+	}
+}
+
+func TestETag(t *testing.T) {
+	key := renderKey("full", "x")
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	if checkETag(w, r, key) || w.Header().Get("etag") != "" {
+		t.Errorf("checkETag without If-None-Match: code %d, etag %q", w.Code, w.Header().Get("etag"))
+	}
+
+	r.Header.Set("If-None-Match", `"other", W/"`+key+`"`)
+	w = httptest.NewRecorder()
+	if !checkETag(w, r, key) || w.Code != http.StatusNotModified || w.Header().Get("etag") != `"`+key+`"` {
+		t.Errorf("checkETag with a match: code %d, etag %q", w.Code, w.Header().Get("etag"))
+	}
+
+	// streamed renders only get the ETag once they write something
+	w = httptest.NewRecorder()
+	ew := &etagWriter{w: w, key: key}
+	if w.Header().Get("etag") != "" {
+		t.Error("etag set before the first write")
+	}
+	ew.Write([]byte("GIF89a"))
+	if !ew.wrote || w.Header().Get("etag") != `"`+key+`"` {
+		t.Errorf("etag %q after the first write", w.Header().Get("etag"))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rmmh/rplace/events"
+)
+
+const maxReplaySpeed = 100_000
+
+type replayBatch struct {
+	Ts int64 `json:"ts"`
+	// Pixels holds an [x, y, color] triple per change.
+	Pixels [][3]int `json:"pixels"`
+}
+
+// regionParam parses the optional x, y, w and h query parameters, defaulting
+// to the whole canvas.
+func (s *server) regionParam(r *http.Request) (image.Rectangle, error) {
+	vals := r.URL.Query()
+	b := s.p.Bounds()
+	v := [4]int{b.Min.X, b.Min.Y, b.Dx(), b.Dy()}
+	for i, k := range []string{"x", "y", "w", "h"} {
+		if q := vals.Get(k); q != "" {
+			n, err := strconv.Atoi(q)
+			if err != nil || n < 0 {
+				return image.Rectangle{}, fmt.Errorf("bad %s", k)
+			}
+			v[i] = n
+		}
+	}
+	region := image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]).Intersect(b)
+	if region.Empty() {
+		return region, fmt.Errorf("region is outside the canvas")
+	}
+	return region, nil
+}
+
+// replayHandler streams pixel changes from a start time as Server-Sent
+// Events, paced to speed times real time. Each message holds the changes
+// made at one instant and has that instant as its id, so reconnecting
+// clients resume where they left off.
+func (s *server) replayHandler(w http.ResponseWriter, r *http.Request) {
+	vals := r.URL.Query()
+
+	from := s.p.Start
+	var err error
+	if v := vals.Get("from"); v != "" {
+		if from, err = parseTime(v); err != nil {
+			http.Error(w, "bad from: "+err.Error(), 400)
+			return
+		}
+	}
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			from = id + 1
+		}
+	}
+
+	speed := 1.0
+	if v := vals.Get("speed"); v != "" {
+		if speed, err = strconv.ParseFloat(v, 64); err != nil || !(speed > 0 && speed <= maxReplaySpeed) {
+			http.Error(w, fmt.Sprintf("speed must be above 0 and at most %d", maxReplaySpeed), 400)
+			return
+		}
+	}
+
+	region, err := s.regionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	er, err := events.Open(s.p, s.events...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer er.Close()
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "event: start\ndata: {\"palette\":%q,\"from\":%d,\"speed\":%g}\n\n", s.p.Pal.Name, from, speed)
+
+	// streams end early when the server shuts down
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopping.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	begin := time.Now()
+	batch := replayBatch{Ts: -1}
+	send := func() error {
+		if len(batch.Pixels) == 0 || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// hold the batch until its moment comes around
+		due := begin.Add(time.Duration(float64(batch.Ts-from) / speed * float64(time.Millisecond)))
+		if wait := time.Until(due); wait > 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			rc.Flush()
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		data, _ := json.Marshal(batch)
+		fmt.Fprintf(bw, "id: %d\ndata: %s\n\n", batch.Ts, data)
+		batch.Pixels = batch.Pixels[:0]
+		return nil
+	}
+
+	for {
+		e, err := er.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Println("replay:", err)
+			break
+		}
+		if e.Ts < from || !(image.Point{e.X, e.Y}).In(region) {
+			continue
+		}
+		if e.Ts != batch.Ts {
+			if err := send(); err != nil {
+				return
+			}
+			batch.Ts = e.Ts
+		}
+		batch.Pixels = append(batch.Pixels, [3]int{e.X, e.Y, int(e.Color)})
+	}
+	if send() != nil {
+		return
+	}
+	fmt.Fprint(bw, "event: end\ndata: {}\n\n")
+	bw.Flush()
+	rc.Flush()
+}
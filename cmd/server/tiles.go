@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rmmh/rplace/delta"
+)
+
+const tileSize = 256
+
+// maxZoom is the zoom level where one tile pixel is one canvas pixel. Each
+// level below it halves the resolution, down to a single tile at zoom 0.
+func (s *server) maxZoom() int {
+	z := 0
+	for tileSize<<z < s.p.Width() || tileSize<<z < s.p.Height() {
+		z++
+	}
+	return z
+}
+
+// downsample shrinks im by scale, taking the most common color of each
+// scale x scale block so thin lines and text stay legible.
+func downsample(im *image.Paletted, scale int) *image.Paletted {
+	r := im.Rect
+	out := image.NewPaletted(image.Rect(0, 0, (r.Dx()+scale-1)/scale, (r.Dy()+scale-1)/scale), im.Palette)
+	counts := make([]int, len(im.Palette))
+	for oy := 0; oy < out.Rect.Dy(); oy++ {
+		for ox := 0; ox < out.Rect.Dx(); ox++ {
+			for i := range counts {
+				counts[i] = 0
+			}
+			for y := r.Min.Y + oy*scale; y < r.Min.Y+(oy+1)*scale && y < r.Max.Y; y++ {
+				row := im.Pix[im.PixOffset(r.Min.X, y):]
+				for x := ox * scale; x < (ox+1)*scale && x < r.Dx(); x++ {
+					counts[row[x]]++
+				}
+			}
+			best := uint8(0)
+			for i := 1; i < len(counts); i++ {
+				if counts[i] > counts[best] {
+					best = uint8(i)
+				}
+			}
+			out.Pix[out.PixOffset(ox, oy)] = best
+		}
+	}
+	return out
+}
+
+func (s *server) tileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ts, _ := strconv.Atoi(vars["ts"])
+	z, _ := strconv.Atoi(vars["z"])
+	tx, _ := strconv.Atoi(vars["x"])
+	ty, _ := strconv.Atoi(vars["y"])
+
+	maxZoom := s.maxZoom()
+	if z > maxZoom || tx >= 1<<z || ty >= 1<<z {
+		http.Error(w, "no such tile", 404)
+		return
+	}
+
+	maxTs := s.dr.LatestBefore(ts)
+	if maxTs != ts && !r.URL.Query().Has("full") {
+		http.Redirect(w, r, fmt.Sprintf("../../../%d/%d/%d/%d.png", maxTs, z, tx, ty), http.StatusMovedPermanently)
+		return
+	}
+
+	scale := 1 << (maxZoom - z)
+	span := tileSize * scale
+	region := image.Rect(tx*span, ty*span, (tx+1)*span, (ty+1)*span)
+
+	c, err := s.dr.Composite(ts, delta.CompositeOptions{Region: region})
+	if err == delta.ErrNoFrames {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// place the composite, which stops at the canvas edge, on a full tile
+	tile := image.NewPaletted(image.Rect(0, 0, tileSize, tileSize), s.p.Palette)
+	im := c.Image
+	if scale > 1 {
+		im = downsample(im, scale)
+	}
+	off := c.Image.Rect.Min.Sub(region.Min).Div(scale)
+	for y := 0; y < im.Rect.Dy(); y++ {
+		copy(tile.Pix[tile.PixOffset(off.X, off.Y+y):], im.Pix[im.PixOffset(im.Rect.Min.X, im.Rect.Min.Y+y):][:im.Rect.Dx()])
+	}
+
+	w.Header().Add("cache-control", "max-age=25920000")
+	w.Header().Set("content-type", "image/png")
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	err = enc.Encode(w, tile)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
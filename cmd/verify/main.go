@@ -0,0 +1,69 @@
+// rebuild every stored frame and check it against the hash recorded when it
+// was written. Exits nonzero if any frame fails.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/profile"
+)
+
+var (
+	dataDir     = flag.String("datadir", ".", "directory holding canvas zips")
+	frames      = flag.String("frames", "", "comma-separated canvas zips, tars, PNG directories or globs to check instead of the zips in -datadir")
+	profileName = flag.String("profile", profile.Default, "canvas profile: 2017, 2022 or 2023")
+	strict      = flag.Bool("strict", false, "also fail if any frame has no stored hash")
+)
+
+func main() {
+	flag.Parse()
+
+	p, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	patterns := []string{
+		filepath.Join(*dataDir, "canvas_full.zip"),
+		filepath.Join(*dataDir, "canvas_delta*.zip"),
+		filepath.Join(*dataDir, "canvas_ticks*.zip"),
+	}
+	if *frames != "" {
+		patterns = strings.Split(*frames, ",")
+	}
+
+	dr, err := delta.MakeDeltaReader(p, patterns...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dr.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := dr.Verify(ctx, func(done, total int) {
+		if done%100 == 0 || done == total {
+			fmt.Fprintf(os.Stderr, "%d/%d\r", done, total)
+		}
+	})
+	fmt.Fprintln(os.Stderr)
+	for _, f := range res.Failures {
+		fmt.Println("FAIL", f)
+	}
+	fmt.Printf("%d frames checked, %d failed, %d without hashes\n", res.Checked, len(res.Failures), res.Unhashed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(res.Failures) > 0 || (*strict && res.Unhashed > 0) {
+		os.Exit(1)
+	}
+}
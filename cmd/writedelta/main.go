@@ -5,8 +5,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/base32"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
@@ -22,16 +21,19 @@ import (
 	"sync"
 	"time"
 
-	"golang.org/x/image/bmp"
 	"golang.org/x/sync/semaphore"
 
 	"github.com/rmmh/rplace/delta"
+	"github.com/rmmh/rplace/profile"
 )
 
 var (
-	dataDir = flag.String("datadir", ".", "directory to store canvas zips")
-	imgDir  = flag.String("imgdir", "", "directory to read pngs from")
-	urls    = flag.String("urls", "", "file of full image urls to inject as canvas_ticks.zip")
+	dataDir     = flag.String("datadir", ".", "directory to store canvas zips")
+	imgDir      = flag.String("imgdir", "", "directory to read pngs from")
+	urls        = flag.String("urls", "", "file of full image urls to inject as canvas_ticks.zip")
+	profileName = flag.String("profile", profile.Default, "canvas profile: 2017, 2022 or 2023")
+	chainDepth  = flag.Int("chaindepth", 0, "store ticks as deltas against the previous tick, up to this many deltas deep")
+	format      = flag.String("format", "png", "delta encoding: png or spd (sparse runs)")
 )
 
 func loadPng(path string) *image.Paletted {
@@ -39,7 +41,7 @@ func loadPng(path string) *image.Paletted {
 	if err != nil {
 		log.Fatal(path, err)
 	}
-	im, err := png.Decode(f)
+	im, err := delta.DecodePaletted(f, prof.Palette)
 	if err != nil {
 		log.Fatal(path, err)
 	}
@@ -47,7 +49,7 @@ func loadPng(path string) *image.Paletted {
 	if err != nil {
 		log.Fatal(path, err)
 	}
-	return im.(*image.Paletted)
+	return im
 }
 
 type TimestampedImage struct {
@@ -56,16 +58,10 @@ type TimestampedImage struct {
 	img        *image.Paletted
 }
 
-func imhash(im image.Image) string {
-	h := sha1.New()
-	bmp.Encode(h, im)
-	return base32.StdEncoding.EncodeToString(h.Sum(nil))
-}
-
 func computeDelta(base, target *image.Paletted) *image.Paletted {
-	delta := image.NewPaletted(image.Rect(0, 0, 1000, 1000), base.Palette)
-	for y := 0; y < 1000; y++ {
-		for x := 0; x < 1000; x++ {
+	delta := image.NewPaletted(base.Rect, base.Palette)
+	for y := base.Rect.Min.Y; y < base.Rect.Max.Y; y++ {
+		for x := base.Rect.Min.X; x < base.Rect.Max.X; x++ {
 			newColor := target.ColorIndexAt(x, y)
 			if newColor != base.ColorIndexAt(x, y) {
 				delta.SetColorIndex(x, y, newColor)
@@ -75,23 +71,56 @@ func computeDelta(base, target *image.Paletted) *image.Paletted {
 	return delta
 }
 
-func writeDelta(target, base TimestampedImage, n int, add OrderedZipAdder) {
-	im := loadPng(target.path)
-	hashInput := imhash(im)
-	diff := computeDelta(base.img, im)
-	header := &zip.FileHeader{
-		Name:     fmt.Sprintf("%d-%d-%d.png", target.ts, target.canvas, base.ts),
-		Modified: time.Unix(0, int64(target.ts)*int64(time.Millisecond)),
+// encodeDelta encodes the delta from base to im in the -format chosen,
+// checking that decoding it rebuilds an image with hash hashInput. It returns
+// the file extension, zip method and contents to store.
+func encodeDelta(base, im *image.Paletted, hashInput string) (string, uint16, *bytes.Buffer) {
+	diff := computeDelta(base, im)
+	buf := &bytes.Buffer{}
+
+	ext, method := ".png", zip.Store
+	var recon *image.Paletted
+	if *format == "spd" {
+		ext, method = delta.SparseExt, zip.Deflate
+		err := delta.EncodeSparse(buf, delta.MakeSparse(diff))
+		if err != nil {
+			log.Fatal(err)
+		}
+		s, err := delta.DecodeSparse(bytes.NewReader(buf.Bytes()), prof.Palette)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recon, err = delta.ApplySparse(base, s)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		png.Encode(buf, diff)
+		var err error
+		if recon, err = delta.ApplyDelta(base, diff); err != nil {
+			log.Fatal(err)
+		}
 	}
-	pngbuf := bytes.Buffer{}
-	png.Encode(&pngbuf, diff)
-	add(header, &pngbuf, n)
 
-	recon := delta.ApplyDelta(base.img, diff)
-	hashRecon := imhash(recon)
+	hashRecon := delta.ImageHash(recon)
 	if hashRecon != hashInput {
 		log.Fatal("RECON FAILED")
 	}
+	return ext, method, buf
+}
+
+func writeDelta(target, base TimestampedImage, n int, add OrderedZipAdder) {
+	im := loadPng(target.path)
+	hashInput := delta.ImageHash(im)
+	ext, method, buf := encodeDelta(base.img, im, hashInput)
+
+	header := &zip.FileHeader{
+		Name:     fmt.Sprintf("%d-%d-%d%s", target.ts, target.canvas, base.ts, ext),
+		Method:   method,
+		Modified: time.Unix(0, int64(target.ts)*int64(time.Millisecond)),
+		Comment:  hashInput,
+	}
+	add(header, buf, n)
 }
 
 type OrderedZipWriter struct {
@@ -101,8 +130,10 @@ type OrderedZipWriter struct {
 }
 
 func NewOrderedZipWriter(w io.Writer) *OrderedZipWriter {
+	zw := zip.NewWriter(w)
+	zw.SetComment(delta.PaletteComment(prof.Pal.Name))
 	return &OrderedZipWriter{
-		w: zip.NewWriter(w),
+		w: zw,
 		c: *sync.NewCond(&sync.Mutex{}),
 	}
 }
@@ -157,7 +188,7 @@ func makeFullDelta() {
 	semWeight := int64(64)
 	sem := semaphore.NewWeighted(semWeight)
 
-	for canvas := 0; canvas <= 6; canvas++ {
+	for canvas := 0; canvas < prof.Canvases; canvas++ {
 		pattern := fmt.Sprintf("%s/*-%d-f-*.png", *imgDir, canvas)
 		matches, err := filepath.Glob(pattern)
 		if err != nil {
@@ -185,7 +216,7 @@ func makeFullDelta() {
 		baseImages := []TimestampedImage{}
 
 		// first, determine the base images at given intervals
-		for queryTime := 1689858080999; queryTime <= 1690320892999; queryTime += 120_000 {
+		for queryTime := int(prof.Start); queryTime <= int(prof.End); queryTime += 120_000 {
 			i := sort.Search(len(images), func(i int) bool {
 				return images[i].ts > queryTime
 			}) - 1
@@ -209,6 +240,7 @@ func makeFullDelta() {
 				bfw.Add(&zip.FileHeader{
 					Name:     fmt.Sprintf("%d-%d.png", i.ts, canvas),
 					Modified: time.Unix(0, int64(i.ts)*int64(time.Millisecond)),
+					Comment:  delta.ImageHash(i.img),
 				}, &pngbuf, n)
 				sem.Release(1)
 			}(match, bfw.NextNumber())
@@ -260,32 +292,63 @@ func makeFullDelta() {
 		float64(bfo)/1024/1024, float64(bdo)/1024/1024, float64(bfo+bdo)/1024/1024)
 }
 
-func writeTick(target TimestampedImage, base *delta.DeltaReaderEntry, baseImg *image.Paletted, n int, add OrderedZipAdder, fetch func(string) *image.Paletted) {
+// tickImage is a tick frame that may still be being fetched.
+type tickImage struct {
+	ready chan struct{}
+	img   *image.Paletted
+}
+
+func newTickImage() *tickImage {
+	return &tickImage{ready: make(chan struct{})}
+}
+
+func (t *tickImage) Set(im *image.Paletted) {
+	t.img = im
+	close(t.ready)
+}
+
+func (t *tickImage) Get() *image.Paletted {
+	<-t.ready
+	return t.img
+}
+
+// lastTick is the most recent tick written for a canvas, which the next tick
+// may be stored as a delta against.
+type lastTick struct {
+	ts    int
+	chain []int
+	img   *tickImage
+}
+
+func writeTick(target TimestampedImage, chain []int, base, out *tickImage, n int, add OrderedZipAdder, fetch func(string) *image.Paletted) {
 	im := fetch(target.path)
-	hashInput := imhash(im)
-	diff := computeDelta(baseImg, im)
+	out.Set(im)
+	hashInput := delta.ImageHash(im)
+	ext, method, buf := encodeDelta(base.Get(), im, hashInput)
+
 	header := &zip.FileHeader{
+		Name:     fmt.Sprintf("%d-%d", target.ts, target.canvas),
+		Method:   method,
 		Modified: time.Unix(0, int64(target.ts)*int64(time.Millisecond)),
+		Comment:  hashInput,
 	}
-	if base.Base > 0 {
-		header.Name = fmt.Sprintf("%d-%d-%d-%d.png", target.ts, target.canvas, base.Ts, base.Base)
-	} else {
-		header.Name = fmt.Sprintf("%d-%d-%d.png", target.ts, target.canvas, base.Ts)
+	for _, ts := range chain {
+		header.Name += fmt.Sprintf("-%d", ts)
 	}
-	pngbuf := bytes.Buffer{}
-	png.Encode(&pngbuf, diff)
-	add(header, &pngbuf, n)
+	header.Name += ext
+	add(header, buf, n)
+}
 
-	recon := delta.ApplyDelta(baseImg, diff)
-	hashRecon := imhash(recon)
-	if hashRecon != hashInput {
-		log.Fatal("RECON FAILED")
+func abs(x int) int {
+	if x < 0 {
+		return -x
 	}
+	return x
 }
 
 func makeTickDelta(urlspath string) {
-	deltaReader, err := delta.MakeDeltaReader(
-		filepath.Join(*dataDir, "canvas_full.zip"), filepath.Join(*dataDir, "canvas_delta.zip"), "")
+	deltaReader, err := delta.MakeDeltaReader(prof,
+		filepath.Join(*dataDir, "canvas_full.zip"), filepath.Join(*dataDir, "canvas_delta.zip"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -310,6 +373,7 @@ func makeTickDelta(urlspath string) {
 	var zw *OrderedZipWriter
 
 	haves := map[int]bool{}
+	lastTicks := map[int]*lastTick{}
 
 	for {
 		p := fmt.Sprintf("%s/canvas_ticks.%05d.zip", *dataDir, tn+1)
@@ -383,14 +447,29 @@ func makeTickDelta(urlspath string) {
 			fmt.Println("HAVE", ts)
 			continue
 		}
-		fmt.Println(u, m.Ts, m.Base)
-		im, err := deltaReader.GetImage(m)
-		if err != nil {
-			log.Fatal(err)
+
+		var chain []int
+		var base *tickImage
+		last := lastTicks[canvas]
+		if *chainDepth > 0 && last != nil && last.ts < ts && len(last.chain) < *chainDepth &&
+			ts-last.ts < abs(ts-m.Ts) {
+			chain = append([]int{last.ts}, last.chain...)
+			base = last.img
+		} else {
+			chain = append([]int{m.Ts}, deltaReader.Chain(m)...)
+			im, err := deltaReader.GetImage(m)
+			if err != nil {
+				log.Fatal(err)
+			}
+			base = newTickImage()
+			base.Set(im)
 		}
+		fmt.Println(u, chain)
+		out := newTickImage()
+		lastTicks[canvas] = &lastTick{ts: ts, chain: chain, img: out}
 
 		sem.Acquire(context.Background(), 1)
-		go writeTick(TimestampedImage{ts: ts, canvas: canvas, path: u}, m, im, zw.NextNumber(), func(header *zip.FileHeader, r io.Reader, n int) {
+		go writeTick(TimestampedImage{ts: ts, canvas: canvas, path: u}, chain, base, out, zw.NextNumber(), func(header *zip.FileHeader, r io.Reader, n int) {
 			zw.Add(header, r, n)
 			sem.Release(1)
 		}, func(url string) *image.Paletted {
@@ -407,14 +486,18 @@ func makeTickDelta(urlspath string) {
 					time.Sleep(10 * time.Second)
 					continue
 				}
-				im, err := png.Decode(resp.Body)
+				im, err := delta.DecodePaletted(resp.Body, prof.Palette)
 				resp.Body.Close()
+				var perr *delta.PaletteError
+				if errors.As(err, &perr) {
+					log.Fatal(url, err)
+				}
 				if err != nil {
-					log.Println("unable to decode image??")
+					log.Println("unable to decode image??", err)
 					time.Sleep(10 * time.Second)
 					continue
 				}
-				return im.(*image.Paletted)
+				return im
 			}
 		})
 
@@ -432,8 +515,18 @@ func makeTickDelta(urlspath string) {
 		fmt.Sprintf("%s/canvas_ticks.%05d.zip", *dataDir, tn))
 }
 
+var prof *profile.Profile
+
 func main() {
 	flag.Parse()
+	var err error
+	prof, err = profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *format != "png" && *format != "spd" {
+		log.Fatal("unknown -format ", *format)
+	}
 	if *urls != "" {
 		makeTickDelta(*urls)
 	} else {
@@ -0,0 +1,216 @@
+// Package columnar reads COLMPACK files, which store the pixel change
+// events of a canvas grouped by pixel, so one pixel's history can be read
+// without scanning the whole event stream.
+package columnar
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/rmmh/rplace/profile"
+)
+
+var ErrBadHeader = errors.New("not a COLMPACK file")
+
+// ColumnarReader reads a COLMPACK file: the magic, a uint64 start time, a
+// uint32 offset of the first history, then a uvarint history length per
+// pixel in row order, followed by the histories.
+type ColumnarReader struct {
+	// ID identifies the file's contents for caching renders.
+	ID      string
+	StartTs uint64
+	// EndTs is the end of the event, as the file doesn't record its last
+	// event.
+	EndTs         uint64
+	Width, Height int
+	// blank is the API color of pixels not yet placed
+	blank uint8
+
+	f         io.ReaderAt
+	offsets   []uint32
+	bytesRead atomic.Int64
+}
+
+func MakeColumnarReader(filename string, p *profile.Profile) (*ColumnarReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "COLMPACK" {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, ErrBadHeader)
+	}
+
+	r := &ColumnarReader{
+		ID:      fmt.Sprintf("%s %d %d", filepath.Base(filename), st.Size(), st.ModTime().UnixNano()),
+		f:       f,
+		EndTs:   uint64(p.End),
+		Width:   p.Width(),
+		Height:  p.Height(),
+		blank:   p.Blank - 1,
+		offsets: make([]uint32, p.Width()*p.Height()+1),
+	}
+
+	var o uint32
+	err = binary.Read(f, binary.LittleEndian, &r.StartTs)
+	if err == nil {
+		err = binary.Read(f, binary.LittleEndian, &o)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, ErrBadHeader)
+	}
+
+	r.offsets[0] = o
+	br := bufio.NewReader(f)
+	for i := 0; i < r.Width*r.Height; i++ {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: history lengths: %w", filename, ErrBadHeader)
+		}
+		o += uint32(n)
+		r.offsets[i+1] = o
+	}
+	if int64(o) > st.Size() {
+		f.Close()
+		return nil, fmt.Errorf("%s: histories end at %d, past the end of the file: %w", filename, o, ErrBadHeader)
+	}
+
+	return r, nil
+}
+
+// HistoryEntry is one change to a pixel: the API color index in the low 5
+// bits, and the time since the pixel's previous change above them.
+type HistoryEntry uint64
+
+func (h HistoryEntry) Color() uint8 {
+	return uint8(h & 31)
+}
+
+func (h HistoryEntry) Ts() uint32 {
+	return uint32(h >> 5)
+}
+
+func (h HistoryEntry) String() string {
+	return fmt.Sprintf("%d:%d", h.Ts(), h.Color())
+}
+
+// PixelData returns the encoded history of a pixel: a uvarint HistoryEntry
+// per event, with timestamps relative to the previous event.
+func (r *ColumnarReader) PixelData(x, y int) []byte {
+	if x < 0 || x >= r.Width || y < 0 || y >= r.Height {
+		return nil
+	}
+	return r.span(x+y*r.Width, 1)
+}
+
+// span reads the histories of n consecutive pixels starting at offset o.
+func (r *ColumnarReader) span(o, n int) []byte {
+	buf := make([]byte, r.offsets[o+n]-r.offsets[o])
+	read, _ := r.f.ReadAt(buf, int64(r.offsets[o]))
+	r.bytesRead.Add(int64(read))
+	return buf
+}
+
+// BytesRead counts the bytes of histories read so far.
+func (r *ColumnarReader) BytesRead() int64 {
+	return r.bytesRead.Load()
+}
+
+// Close closes the file.
+func (r *ColumnarReader) Close() error {
+	if c, ok := r.f.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Bounds is the rectangle of the canvas.
+func (r *ColumnarReader) Bounds() image.Rectangle {
+	return image.Rect(0, 0, r.Width, r.Height)
+}
+
+// eachPixel calls fn with the encoded history of each pixel of region, which
+// must be within Bounds, and its index in row order.
+func (r *ColumnarReader) eachPixel(region image.Rectangle, fn func(i int, pix []byte)) {
+	i := 0
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		// a row's histories are stored together, so read them at once
+		o := region.Min.X + y*r.Width
+		buf := r.span(o, region.Dx())
+		base := r.offsets[o]
+		for x := 0; x < region.Dx(); x, i = x+1, i+1 {
+			fn(i, buf[r.offsets[o+x]-base:r.offsets[o+x+1]-base])
+		}
+	}
+}
+
+// walk calls fn with the absolute time and API color of each change in an
+// encoded history, until it returns false.
+func (r *ColumnarReader) walk(pix []byte, fn func(ts int64, color uint8) bool) {
+	ts := int64(r.StartTs)
+	for len(pix) > 0 {
+		e, n := binary.Uvarint(pix)
+		if n <= 0 {
+			return
+		}
+		pix = pix[n:]
+		ts += int64(HistoryEntry(e).Ts())
+		if !fn(ts, HistoryEntry(e).Color()) {
+			return
+		}
+	}
+}
+
+// LastChanged returns the time of the last change at or before ts to each
+// pixel of region, in row order, or 0 for pixels unchanged by then. Pixels
+// placed in the color they already had don't change.
+func (r *ColumnarReader) LastChanged(ts int64, region image.Rectangle) []int64 {
+	region = region.Intersect(r.Bounds())
+	last := make([]int64, region.Dx()*region.Dy())
+	r.eachPixel(region, func(i int, pix []byte) {
+		prev := r.blank
+		r.walk(pix, func(t int64, c uint8) bool {
+			if t > ts {
+				return false
+			}
+			if c != prev {
+				last[i], prev = t, c
+			}
+			return true
+		})
+	})
+	return last
+}
+
+func (r *ColumnarReader) GetPixelHistory(x, y int) []HistoryEntry {
+	buf := r.PixelData(x, y)
+
+	ents := make([]HistoryEntry, 0, len(buf)/2)
+	for o := 0; o < len(buf); {
+		e, n := binary.Uvarint(buf[o:])
+		if n <= 0 {
+			break
+		}
+		o += n
+		ents = append(ents, HistoryEntry(e))
+	}
+
+	return ents
+}
@@ -0,0 +1,188 @@
+package columnar
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rmmh/rplace/palette"
+	"github.com/rmmh/rplace/profile"
+)
+
+// testProfile is a single 4x3 canvas.
+var testProfile = &profile.Profile{
+	Name:     "test",
+	Canvases: 1, TileWidth: 4, TileHeight: 3,
+	Offsets: []image.Point{{0, 0}},
+	Pal:     palette.Palette2017,
+	Palette: palette.Palette2017.Colors,
+	Blank:   1,
+	End:     5000,
+}
+
+type change struct {
+	ts    int64
+	color uint8
+}
+
+// testHistories are the changes to pixels by offset, starting at time 1000.
+// Pixel 2 is placed again in the same color, and pixel 3 in the blank color.
+var testHistories = map[int][]change{
+	0:  {{1000, 3}, {1100, 4}, {1500, 5}},
+	2:  {{1000, 3}, {1200, 3}},
+	3:  {{1100, 0}},
+	5:  {{1200, 2}},
+	6:  {{1300, 7}, {1300, 8}},
+	11: {{1000, 1}, {4000, 9}},
+}
+
+// writeColumnar writes a COLMPACK file of histories for the test profile.
+func writeColumnar(t *testing.T, start uint64, hists map[int][]change) string {
+	t.Helper()
+	n := testProfile.Width() * testProfile.Height()
+	var lens, data []byte
+	for i := 0; i < n; i++ {
+		before := len(data)
+		last := int64(start)
+		for _, c := range hists[i] {
+			data = binary.AppendUvarint(data, uint64(c.ts-last)<<5|uint64(c.color))
+			last = c.ts
+		}
+		lens = binary.AppendUvarint(lens, uint64(len(data)-before))
+	}
+	b := binary.LittleEndian.AppendUint64([]byte("COLMPACK"), start)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(b)+4+len(lens)))
+	b = append(append(b, lens...), data...)
+	path := filepath.Join(t.TempDir(), "col.bin")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openTest(t *testing.T) *ColumnarReader {
+	t.Helper()
+	r, err := MakeColumnarReader(writeColumnar(t, 1000, testHistories), testProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestPixelHistory(t *testing.T) {
+	r := openTest(t)
+	if r.StartTs != 1000 || r.EndTs != 5000 || r.Bounds() != image.Rect(0, 0, 4, 3) {
+		t.Errorf("start %d, end %d, bounds %v", r.StartTs, r.EndTs, r.Bounds())
+	}
+	for o := 0; o < 12; o++ {
+		hist := r.GetPixelHistory(o%4, o/4)
+		want := testHistories[o]
+		if len(hist) != len(want) {
+			t.Errorf("pixel %d: history %v, want %v", o, hist, want)
+			continue
+		}
+		ts := int64(r.StartTs)
+		for i, e := range hist {
+			ts += int64(e.Ts())
+			if ts != want[i].ts || e.Color() != want[i].color {
+				t.Errorf("pixel %d change %d at %d to %d, want %v", o, i, ts, e.Color(), want[i])
+			}
+		}
+	}
+	if d := r.PixelData(4, 0); d != nil {
+		t.Errorf("PixelData off the canvas = %v", d)
+	}
+	if r.BytesRead() == 0 {
+		t.Error("BytesRead didn't count the histories")
+	}
+}
+
+func TestLastChanged(t *testing.T) {
+	r := openTest(t)
+	for _, tc := range []struct {
+		ts     int64
+		region image.Rectangle
+		want   []int64
+	}{
+		{999, image.Rect(0, 0, 2, 1), []int64{0, 0}},
+		{1100, image.Rect(0, 0, 2, 1), []int64{1100, 0}},
+		{1300, image.Rect(1, 1, 3, 2), []int64{1200, 1300}},
+		// placing a pixel in its current color doesn't change it
+		{1300, image.Rect(2, 0, 4, 1), []int64{1000, 0}},
+		// regions are clipped to the canvas
+		{9000, image.Rect(2, 2, 8, 8), []int64{0, 4000}},
+	} {
+		got := r.LastChanged(tc.ts, tc.region)
+		if len(got) != len(tc.want) {
+			t.Errorf("LastChanged(%d, %v) = %v, want %v", tc.ts, tc.region, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("LastChanged(%d, %v) = %v, want %v", tc.ts, tc.region, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	r := openTest(t)
+	h := r.Heatmap(1100, 1500, image.Rect(-1, -1, 9, 9))
+	// every placement counts, even those not changing the color
+	want := []uint32{2, 0, 1, 1, 0, 1, 2, 0, 0, 0, 0, 0}
+	if h.Rect != r.Bounds() || h.Max != 2 || h.Total != 7 {
+		t.Errorf("heatmap of %v with max %d and total %d", h.Rect, h.Max, h.Total)
+	}
+	for i := range want {
+		if h.Counts[i] != want[i] {
+			t.Fatalf("counts %v, want %v", h.Counts, want)
+		}
+	}
+
+	d := h.Downscale(2)
+	if d.Rect != image.Rect(0, 0, 2, 2) || d.Counts[0] != 3 || d.Counts[1] != 4 || d.Max != 4 || d.Total != 7 {
+		t.Errorf("downscaled to %v %v with max %d", d.Rect, d.Counts, d.Max)
+	}
+
+	if hot := h.Hottest(2, 1); len(hot) != 1 || hot[0] != (Region{2, 0, 2, 2, 4}) {
+		t.Errorf("Hottest = %v", hot)
+	}
+
+	im := h.Image(0, 2)
+	if im.Bounds() != image.Rect(0, 0, 8, 6) {
+		t.Fatalf("image bounds %v", im.Bounds())
+	}
+	if im.ColorIndexAt(1, 1) != 255 || im.ColorIndexAt(2, 0) != 0 {
+		t.Errorf("hottest pixel %d, coldest %d", im.ColorIndexAt(1, 1), im.ColorIndexAt(2, 0))
+	}
+	if c := im.ColorIndexAt(2, 2); c == 0 || c == 255 {
+		t.Errorf("pixel changed once colored %d", c)
+	}
+}
+
+func TestBadHeader(t *testing.T) {
+	good, err := os.ReadFile(writeColumnar(t, 1000, testHistories))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"wrong magic", []byte("PIXLPACK........")},
+		{"no start time", good[:12]},
+		{"no offset", good[:18]},
+		{"truncated lengths", good[:22]},
+		{"truncated histories", good[:len(good)-1]},
+	} {
+		path := filepath.Join(t.TempDir(), "col.bin")
+		os.WriteFile(path, tc.data, 0644)
+		if _, err := MakeColumnarReader(path, testProfile); !errors.Is(err, ErrBadHeader) {
+			t.Errorf("%s: err = %v, want ErrBadHeader", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package columnar
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// Heatmap counts the changes to each pixel of a region over a time window.
+type Heatmap struct {
+	Rect image.Rectangle
+	// Counts holds a count per pixel of Rect, in row order.
+	Counts []uint32
+	Max    uint32
+	Total  int
+}
+
+// Heatmap counts the changes to each pixel of region made at times from <= ts
+// <= to.
+func (r *ColumnarReader) Heatmap(from, to int64, region image.Rectangle) *Heatmap {
+	region = region.Intersect(r.Bounds())
+	h := &Heatmap{Rect: region, Counts: make([]uint32, region.Dx()*region.Dy())}
+	r.eachPixel(region, func(i int, pix []byte) {
+		n := uint32(0)
+		r.walk(pix, func(ts int64, _ uint8) bool {
+			if ts > to {
+				return false
+			}
+			if ts >= from {
+				n++
+			}
+			return true
+		})
+		h.Counts[i] = n
+		h.Total += int(n)
+		if n > h.Max {
+			h.Max = n
+		}
+	})
+	return h
+}
+
+// Downscale sums the counts of each scale x scale block. The result's Rect
+// starts at the origin.
+func (h *Heatmap) Downscale(scale int) *Heatmap {
+	w, ht := h.Rect.Dx(), h.Rect.Dy()
+	out := &Heatmap{
+		Rect:   image.Rect(0, 0, (w+scale-1)/scale, (ht+scale-1)/scale),
+		Counts: make([]uint32, ((w+scale-1)/scale)*((ht+scale-1)/scale)),
+		Total:  h.Total,
+	}
+	ow := out.Rect.Dx()
+	for y := 0; y < ht; y++ {
+		for x := 0; x < w; x++ {
+			out.Counts[x/scale+y/scale*ow] += h.Counts[x+y*w]
+		}
+	}
+	for _, n := range out.Counts {
+		if n > out.Max {
+			out.Max = n
+		}
+	}
+	return out
+}
+
+// inferno is a perceptually uniform colormap running from black through
+// purple and orange to pale yellow.
+var inferno = []color.RGBA{
+	{0x00, 0x00, 0x04, 0xff},
+	{0x1b, 0x0c, 0x41, 0xff},
+	{0x4a, 0x0c, 0x6b, 0xff},
+	{0x78, 0x1c, 0x6d, 0xff},
+	{0xa5, 0x2c, 0x60, 0xff},
+	{0xcf, 0x44, 0x46, 0xff},
+	{0xed, 0x69, 0x25, 0xff},
+	{0xfb, 0x9b, 0x06, 0xff},
+	{0xfc, 0xff, 0xa4, 0xff},
+}
+
+// HeatmapPalette is inferno interpolated to 256 colors.
+var HeatmapPalette = func() color.Palette {
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		f := float64(i) / 255 * float64(len(inferno)-1)
+		j := int(f)
+		if j == len(inferno)-1 {
+			j--
+		}
+		t := f - float64(j)
+		a, b := inferno[j], inferno[j+1]
+		lerp := func(a, b uint8) uint8 { return uint8(math.Round(float64(a) + t*(float64(b)-float64(a)))) }
+		pal[i] = color.RGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 0xff}
+	}
+	return pal
+}()
+
+// Image colors the counts with HeatmapPalette on a log scale, so that
+// max, or h.Max if max is 0, is the brightest, and magnifies each pixel into
+// a scale x scale block.
+func (h *Heatmap) Image(max uint32, scale int) *image.Paletted {
+	if max == 0 {
+		max = h.Max
+	}
+	w, ht := h.Rect.Dx(), h.Rect.Dy()
+	out := image.NewPaletted(image.Rect(0, 0, w*scale, ht*scale), HeatmapPalette)
+	lmax := math.Log1p(float64(max))
+	for y := 0; y < ht; y++ {
+		for x := 0; x < w; x++ {
+			c := uint8(0)
+			if n := h.Counts[x+y*w]; n >= max {
+				c = 255
+			} else if n > 0 {
+				c = uint8(math.Log1p(float64(n)) / lmax * 255)
+			}
+			for sy := 0; sy < scale; sy++ {
+				row := out.Pix[out.PixOffset(x*scale, y*scale+sy):]
+				for sx := 0; sx < scale; sx++ {
+					row[sx] = c
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Region is a block of a heatmap and the changes made within it.
+type Region struct {
+	X       int `json:"x"`
+	Y       int `json:"y"`
+	W       int `json:"w"`
+	H       int `json:"h"`
+	Changes int `json:"changes"`
+}
+
+// Hottest splits the heatmap into cell x cell blocks, aligned to the canvas
+// origin, and returns the n with the most changes, most first.
+func (h *Heatmap) Hottest(cell, n int) []Region {
+	blocks := map[image.Point]int{}
+	w := h.Rect.Dx()
+	for i, c := range h.Counts {
+		if c > 0 {
+			x, y := h.Rect.Min.X+i%w, h.Rect.Min.Y+i/w
+			blocks[image.Point{x / cell, y / cell}] += int(c)
+		}
+	}
+	regions := make([]Region, 0, len(blocks))
+	for p, c := range blocks {
+		r := image.Rect(p.X*cell, p.Y*cell, (p.X+1)*cell, (p.Y+1)*cell).Intersect(h.Rect)
+		regions = append(regions, Region{r.Min.X, r.Min.Y, r.Dx(), r.Dy(), c})
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		a, b := regions[i], regions[j]
+		if a.Changes != b.Changes {
+			return a.Changes > b.Changes
+		}
+		if a.Y != b.Y {
+			return a.Y < b.Y
+		}
+		return a.X < b.X
+	})
+	if len(regions) > n {
+		regions = regions[:n]
+	}
+	return regions
+}
@@ -0,0 +1,47 @@
+package delta
+
+import (
+	"context"
+	"image"
+)
+
+// LastChanged returns the timestamp of the first frame at or before ts to show
+// each pixel of region in its current color, in row order, or 0 for pixels
+// still blank. Changes are only as precise as the frames are frequent, and
+// reconstructing every frame up to ts can take a while.
+func (d *DeltaReader) LastChanged(ctx context.Context, ts int, region image.Rectangle) ([]int64, error) {
+	p := d.Profile
+	region = d.compositeRegion(CompositeOptions{Region: region})
+	var canvases []int
+	for canvas := 0; canvas < p.Canvases; canvas++ {
+		if !p.TileRect(canvas).Intersect(region).Empty() {
+			canvases = append(canvases, canvas)
+		}
+	}
+
+	w := region.Dx()
+	last := make([]int64, w*region.Dy())
+	cur := make([]uint8, len(last))
+	for i := range cur {
+		cur[i] = p.Blank
+	}
+
+	it := d.Frames(ctx, 0, ts, canvases...)
+	for it.Next() {
+		f := it.Frame()
+		im := f.Image
+		tile := p.TileRect(f.Entry.Canvas)
+		tr := tile.Intersect(region)
+		for y := tr.Min.Y; y < tr.Max.Y; y++ {
+			src := im.Pix[im.PixOffset(im.Rect.Min.X+tr.Min.X-tile.Min.X, im.Rect.Min.Y+y-tile.Min.Y):]
+			o := tr.Min.X - region.Min.X + (y-region.Min.Y)*w
+			for x, c := range src[:tr.Dx()] {
+				if cur[o+x] != c {
+					cur[o+x] = c
+					last[o+x] = int64(f.Entry.Ts)
+				}
+			}
+		}
+	}
+	return last, it.Err()
+}
@@ -0,0 +1,163 @@
+package delta
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// errLoadPanicked is given to callers waiting on a load that panicked.
+var errLoadPanicked = errors.New("cache load panicked")
+
+// Cache is a concurrency-safe LRU cache bounded by the total size of its
+// values rather than their count. Concurrent loads of the same key share a
+// single call to the loader.
+type Cache[K comparable, V any] struct {
+	mu    sync.Mutex
+	limit int64
+	bytes int64
+	size  func(V) int64
+	ll    *list.List
+	m     map[K]*list.Element
+	loads map[K]*cacheLoad[V]
+
+	hits, misses, shared, evictions int64
+}
+
+type cacheEntry[K comparable, V any] struct {
+	k K
+	v V
+	n int64
+}
+
+type cacheLoad[V any] struct {
+	done chan struct{}
+	v    V
+	err  error
+}
+
+// CacheStats is a snapshot of a Cache's counters.
+type CacheStats struct {
+	Hits, Misses int64
+	// Shared counts lookups that waited on another caller's load.
+	Shared    int64
+	Evictions int64
+	Entries   int
+	Bytes     int64
+	Limit     int64
+}
+
+// NewCache returns a cache holding at most limit bytes, as measured by size.
+func NewCache[K comparable, V any](limit int64, size func(V) int64) *Cache[K, V] {
+	return &Cache[K, V]{
+		limit: limit,
+		size:  size,
+		ll:    list.New(),
+		m:     make(map[K]*list.Element),
+		loads: make(map[K]*cacheLoad[V]),
+	}
+}
+
+func (c *Cache[K, V]) Get(k K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[k]; ok {
+		c.hits++
+		c.ll.MoveToFront(el)
+		return el.Value.(*cacheEntry[K, V]).v, true
+	}
+	c.misses++
+	var zero V
+	return zero, false
+}
+
+func (c *Cache[K, V]) Put(k K, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(k, v)
+}
+
+func (c *Cache[K, V]) put(k K, v V) {
+	// lock must be held
+	n := c.size(v)
+	if el, ok := c.m[k]; ok {
+		ent := el.Value.(*cacheEntry[K, V])
+		c.bytes += n - ent.n
+		ent.v, ent.n = v, n
+		c.ll.MoveToFront(el)
+	} else {
+		c.m[k] = c.ll.PushFront(&cacheEntry[K, V]{k: k, v: v, n: n})
+		c.bytes += n
+	}
+	c.evict()
+}
+
+func (c *Cache[K, V]) evict() {
+	// lock must be held
+	for c.bytes > c.limit && c.ll.Len() > 0 {
+		ent := c.ll.Remove(c.ll.Back()).(*cacheEntry[K, V])
+		delete(c.m, ent.k)
+		c.bytes -= ent.n
+		c.evictions++
+	}
+}
+
+// Load returns the cached value for k, calling load to fill it on a miss.
+// Callers that miss while another load of k is running wait for its result
+// instead of loading again. Errors are returned to every waiter but not
+// cached.
+func (c *Cache[K, V]) Load(k K, load func() (V, error)) (V, error) {
+	c.mu.Lock()
+	if el, ok := c.m[k]; ok {
+		c.hits++
+		c.ll.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry[K, V]).v, nil
+	}
+	if l, ok := c.loads[k]; ok {
+		c.shared++
+		c.mu.Unlock()
+		<-l.done
+		return l.v, l.err
+	}
+	c.misses++
+	l := &cacheLoad[V]{done: make(chan struct{}), err: errLoadPanicked}
+	c.loads[k] = l
+	c.mu.Unlock()
+
+	// clean up even if load panics, so later loads of k don't wait forever
+	defer func() {
+		c.mu.Lock()
+		delete(c.loads, k)
+		if l.err == nil {
+			c.put(k, l.v)
+		}
+		c.mu.Unlock()
+		close(l.done)
+	}()
+	l.v, l.err = load()
+
+	return l.v, l.err
+}
+
+// SetLimit changes the size bound, evicting entries if needed.
+func (c *Cache[K, V]) SetLimit(limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = limit
+	c.evict()
+}
+
+func (c *Cache[K, V]) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Shared:    c.shared,
+		Evictions: c.evictions,
+		Entries:   c.ll.Len(),
+		Bytes:     c.bytes,
+		Limit:     c.limit,
+	}
+}
@@ -0,0 +1,109 @@
+package delta
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func byteLen(b []byte) int64 { return int64(len(b)) }
+
+func TestCacheEvictsBySize(t *testing.T) {
+	c := NewCache[string, []byte](10, byteLen)
+	c.Put("a", make([]byte, 4))
+	c.Put("b", make([]byte, 4))
+	c.Get("a") // b is now least recently used
+	c.Put("c", make([]byte, 4))
+
+	for _, tc := range []struct {
+		k  string
+		ok bool
+	}{{"a", true}, {"b", false}, {"c", true}} {
+		if _, ok := c.Get(tc.k); ok != tc.ok {
+			t.Errorf("Get(%q) ok = %v, want %v", tc.k, ok, tc.ok)
+		}
+	}
+	if st := c.Stats(); st.Bytes != 8 || st.Evictions != 1 {
+		t.Errorf("stats = %+v, want 8 bytes and 1 eviction", st)
+	}
+}
+
+func TestCacheLoadShared(t *testing.T) {
+	c := NewCache[string, []byte](100, byteLen)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	load := func() ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte("v"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Load("k", load); err != nil || string(v) != "v" {
+				t.Errorf("Load = %q, %v", v, err)
+			}
+		}()
+	}
+	// let the loads pile up behind the first
+	for c.Stats().Shared < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called %d times, want 1", n)
+	}
+}
+
+func TestCacheLoadErrorNotCached(t *testing.T) {
+	c := NewCache[string, []byte](100, byteLen)
+	errLoad := errors.New("load failed")
+	if _, err := c.Load("k", func() ([]byte, error) { return nil, errLoad }); err != errLoad {
+		t.Fatalf("Load err = %v, want %v", err, errLoad)
+	}
+	v, err := c.Load("k", func() ([]byte, error) { return []byte("v"), nil })
+	if err != nil || string(v) != "v" {
+		t.Errorf("second Load = %q, %v", v, err)
+	}
+}
+
+func TestCacheLoadPanic(t *testing.T) {
+	c := NewCache[string, []byte](100, byteLen)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic from loader wasn't propagated")
+			}
+		}()
+		c.Load("k", func() ([]byte, error) { panic("boom") })
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		c.Load("k", func() ([]byte, error) { return []byte("v"), nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Load after a panicking load hung")
+	}
+}
+
+func TestApplyWrongSize(t *testing.T) {
+	base := image.NewPaletted(image.Rect(0, 0, 4, 4), nil)
+	small := image.NewPaletted(image.Rect(0, 0, 2, 2), nil)
+	if _, err := ApplyDelta(base, small); err != ErrWrongSize {
+		t.Errorf("ApplyDelta err = %v, want ErrWrongSize", err)
+	}
+	if _, err := ApplySparse(base, MakeSparse(small)); err != ErrWrongSize {
+		t.Errorf("ApplySparse err = %v, want ErrWrongSize", err)
+	}
+}
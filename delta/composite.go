@@ -0,0 +1,147 @@
+package delta
+
+import (
+	"errors"
+	"image"
+)
+
+// DefaultMaxStaleness is how far, in milliseconds, a canvas frame may lag
+// behind the requested time and still be used by Composite.
+const DefaultMaxStaleness = 180_000
+
+// ErrNoFrames is returned by Composite when no canvas has a usable frame.
+var ErrNoFrames = errors.New("no frames found")
+
+type CompositeOptions struct {
+	// MaxStaleness bounds how old a canvas frame may be, in milliseconds.
+	// 0 means DefaultMaxStaleness and a negative value means no limit.
+	MaxStaleness int
+	// Region is the part of the canvas to render, in canvas coordinates.
+	// The zero rectangle means the whole canvas.
+	Region image.Rectangle
+}
+
+// CanvasInfo describes the frame Composite used for one canvas.
+type CanvasInfo struct {
+	Canvas int
+	// Ts is the timestamp of the frame used, or of the newest frame at or
+	// before the requested time if it was too stale. It is 0 if the canvas
+	// has no frame by then.
+	Ts   int
+	Name string
+	// Staleness is how far the frame lags the requested time.
+	Staleness int
+	// Missing is set when the canvas was left transparent because it had no
+	// frame within the staleness limit.
+	Missing bool
+}
+
+// CompositeImage is a stitched view of every canvas at one moment.
+type CompositeImage struct {
+	Image *image.Paletted
+	// Ts is the requested time and Latest the newest frame used.
+	Ts, Latest int
+	// Canvases holds one entry for each canvas overlapping the region.
+	Canvases []CanvasInfo
+}
+
+// Missing returns the canvases left transparent in the image.
+func (c *CompositeImage) Missing() []int {
+	var missing []int
+	for _, ci := range c.Canvases {
+		if ci.Missing {
+			missing = append(missing, ci.Canvas)
+		}
+	}
+	return missing
+}
+
+// LatestBefore returns the timestamp of the newest frame of any canvas at or
+// before ts, or 0 if there is none.
+func (d *DeltaReader) LatestBefore(ts int) int {
+	latest := 0
+	for canvas := range d.Files {
+		e := d.FindNearestLeft(ts, canvas)
+		if e != nil && e.Ts > latest {
+			latest = e.Ts
+		}
+	}
+	return latest
+}
+
+// CompositeInfo reports which frames Composite would use, without decoding
+// them. Images built from the same frames are identical.
+func (d *DeltaReader) CompositeInfo(ts int, opts CompositeOptions) []CanvasInfo {
+	p := d.Profile
+	maxStale := opts.MaxStaleness
+	if maxStale == 0 {
+		maxStale = DefaultMaxStaleness
+	}
+	region := d.compositeRegion(opts)
+	var infos []CanvasInfo
+	for canvas := 0; canvas < p.Canvases; canvas++ {
+		if p.TileRect(canvas).Intersect(region).Empty() {
+			continue
+		}
+		ci := CanvasInfo{Canvas: canvas, Missing: true}
+		e := d.FindNearestLeft(ts, canvas)
+		if e != nil {
+			ci.Ts = e.Ts
+			ci.Name = e.Name
+			ci.Staleness = ts - e.Ts
+			ci.Missing = maxStale >= 0 && ci.Staleness >= maxStale
+		}
+		infos = append(infos, ci)
+	}
+	return infos
+}
+
+func (d *DeltaReader) compositeRegion(opts CompositeOptions) image.Rectangle {
+	region := d.Profile.Bounds()
+	if !opts.Region.Empty() {
+		region = region.Intersect(opts.Region)
+	}
+	return region
+}
+
+// Composite stitches together the newest frame of every canvas at or before
+// ts. Canvases without a recent enough frame are left transparent, and
+// ErrNoFrames is returned if that is all of them.
+func (d *DeltaReader) Composite(ts int, opts CompositeOptions) (*CompositeImage, error) {
+	p := d.Profile
+	region := d.compositeRegion(opts)
+
+	c := &CompositeImage{
+		Image:    image.NewPaletted(region, p.Palette),
+		Ts:       ts,
+		Canvases: d.CompositeInfo(ts, opts),
+	}
+
+	found := false
+	for _, ci := range c.Canvases {
+		if ci.Missing {
+			continue
+		}
+		e := d.FileMap[ci.Canvas][ci.Ts]
+		im, err := d.GetImage(&e)
+		if err != nil {
+			return nil, err
+		}
+		tile := p.TileRect(ci.Canvas)
+		tr := tile.Intersect(region)
+		out := c.Image
+		for y := tr.Min.Y; y < tr.Max.Y; y++ {
+			src := im.PixOffset(im.Rect.Min.X+tr.Min.X-tile.Min.X, im.Rect.Min.Y+y-tile.Min.Y)
+			copy(out.Pix[out.PixOffset(tr.Min.X, y):], im.Pix[src:src+tr.Dx()])
+		}
+		found = true
+		if e.Ts > c.Latest {
+			c.Latest = e.Ts
+		}
+	}
+
+	if !found {
+		return nil, ErrNoFrames
+	}
+	return c, nil
+}
@@ -0,0 +1,76 @@
+package delta
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"testing"
+)
+
+func TestComposite(t *testing.T) {
+	d := writeZip(t, wideProfile, testFrames(t), nil)
+
+	for _, tc := range []struct {
+		name string
+		ts   int
+		opts CompositeOptions
+		// infos is canvas/ts/staleness of each CanvasInfo, with a ! if missing
+		infos  []string
+		latest int
+		// pix are expected colors at points of the composite
+		pix map[image.Point]uint8
+	}{
+		{"both canvases", 250, CompositeOptions{}, []string{"0/200/50", "1/150/100"}, 200,
+			map[image.Point]uint8{{0, 0}: 2, {1, 0}: 1, {4, 0}: 4, {5, 1}: 6}},
+		{"exact time", 300, CompositeOptions{}, []string{"0/300/0", "1/300/0"}, 300,
+			map[image.Point]uint8{{1, 0}: 3, {5, 1}: 5}},
+		{"stale canvas", 250, CompositeOptions{MaxStaleness: 60}, []string{"0/200/50", "1/150/100!"}, 200,
+			map[image.Point]uint8{{0, 0}: 2, {4, 0}: 0}},
+		{"no limit", 100000, CompositeOptions{MaxStaleness: -1}, []string{"0/300/99700", "1/300/99700"}, 300,
+			map[image.Point]uint8{{1, 0}: 3, {4, 0}: 5}},
+		{"canvas without a frame yet", 120, CompositeOptions{}, []string{"0/100/20", "1/0/0!"}, 100,
+			map[image.Point]uint8{{0, 0}: 1, {4, 0}: 0}},
+		{"region", 250, CompositeOptions{Region: image.Rect(3, 1, 6, 3)}, []string{"0/200/50", "1/150/100"}, 200,
+			map[image.Point]uint8{{3, 1}: 1, {5, 1}: 6, {4, 2}: 4}},
+		{"region on one canvas", 250, CompositeOptions{Region: image.Rect(4, 0, 8, 4)}, []string{"1/150/100"}, 150,
+			map[image.Point]uint8{{5, 1}: 6}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var infos []string
+			for _, ci := range d.CompositeInfo(tc.ts, tc.opts) {
+				s := fmt.Sprintf("%d/%d/%d", ci.Canvas, ci.Ts, ci.Staleness)
+				if ci.Missing {
+					s += "!"
+				}
+				infos = append(infos, s)
+			}
+			if fmt.Sprint(infos) != fmt.Sprint(tc.infos) {
+				t.Errorf("CompositeInfo = %v, want %v", infos, tc.infos)
+			}
+
+			c, err := d.Composite(tc.ts, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(c.Canvases) != fmt.Sprint(d.CompositeInfo(tc.ts, tc.opts)) {
+				t.Errorf("Canvases %v don't match CompositeInfo", c.Canvases)
+			}
+			want := d.compositeRegion(tc.opts)
+			if c.Image.Rect != want || c.Ts != tc.ts || c.Latest != tc.latest {
+				t.Errorf("got %v at %d latest %d, want %v at %d latest %d", c.Image.Rect, c.Ts, c.Latest, want, tc.ts, tc.latest)
+			}
+			for pt, want := range tc.pix {
+				if got := c.Image.ColorIndexAt(pt.X, pt.Y); got != want {
+					t.Errorf("pixel %v = %d, want %d", pt, got, want)
+				}
+			}
+		})
+	}
+
+	if _, err := d.Composite(50, CompositeOptions{}); !errors.Is(err, ErrNoFrames) {
+		t.Errorf("Composite before any frame: err %v, want %v", err, ErrNoFrames)
+	}
+	if _, err := d.Composite(300+DefaultMaxStaleness, CompositeOptions{}); !errors.Is(err, ErrNoFrames) {
+		t.Errorf("Composite with only stale frames: err %v, want %v", err, ErrNoFrames)
+	}
+}
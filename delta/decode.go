@@ -0,0 +1,106 @@
+package delta
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// PaletteError reports a pixel whose color isn't in the target palette.
+type PaletteError struct {
+	X, Y  int
+	Color color.Color
+}
+
+func (e *PaletteError) Error() string {
+	r, g, b, a := e.Color.RGBA()
+	return fmt.Sprintf("pixel (%d,%d) has color #%02X%02X%02X/%02X not in palette", e.X, e.Y, r>>8, g>>8, b>>8, a>>8)
+}
+
+// colorKey is a color's premultiplied value. Every fully transparent color
+// has the same key.
+func colorKey(c color.Color) color.RGBA64 {
+	r, g, b, a := c.RGBA()
+	return color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+}
+
+func paletteIndex(pal color.Palette) map[color.RGBA64]uint8 {
+	m := make(map[color.RGBA64]uint8, len(pal))
+	for i, c := range pal {
+		k := colorKey(c)
+		if _, ok := m[k]; !ok {
+			m[k] = uint8(i)
+		}
+	}
+	return m
+}
+
+// DecodePaletted decodes a PNG and maps it onto pal. See ToPalette.
+func DecodePaletted(r io.Reader, pal color.Palette) (*image.Paletted, error) {
+	im, err := png.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return ToPalette(im, pal)
+}
+
+// ToPalette maps every pixel of im onto the entry of pal with exactly the
+// same color. Paletted images are remapped by comparing palettes, so their
+// palette may be in any order or have extra unused entries. A pixel with no
+// exact match gives a *PaletteError.
+func ToPalette(im image.Image, pal color.Palette) (*image.Paletted, error) {
+	index := paletteIndex(pal)
+
+	if src, ok := im.(*image.Paletted); ok {
+		remap := make([]int, 256)
+		identity := len(src.Palette) <= len(pal)
+		for i := range remap {
+			remap[i] = -1
+			if i < len(src.Palette) {
+				if ci, ok := index[colorKey(src.Palette[i])]; ok {
+					remap[i] = int(ci)
+				}
+			}
+			if i < len(src.Palette) && remap[i] != i {
+				identity = false
+			}
+		}
+		if identity {
+			src.Palette = pal
+			return src, nil
+		}
+		out := image.NewPaletted(src.Rect, pal)
+		for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(src.Rect.Min.X, y):][:src.Rect.Dx()]
+			orow := out.Pix[out.PixOffset(src.Rect.Min.X, y):]
+			for x, ci := range row {
+				m := remap[ci]
+				if m < 0 {
+					var c color.Color = color.RGBA{}
+					if int(ci) < len(src.Palette) {
+						c = src.Palette[ci]
+					}
+					return nil, &PaletteError{X: src.Rect.Min.X + x, Y: y, Color: c}
+				}
+				orow[x] = uint8(m)
+			}
+		}
+		return out, nil
+	}
+
+	b := im.Bounds()
+	out := image.NewPaletted(b, pal)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := im.At(x, y)
+			ci, ok := index[colorKey(c)]
+			if !ok {
+				return nil, &PaletteError{X: x, Y: y, Color: c}
+			}
+			out.Pix[out.PixOffset(x, y)] = ci
+		}
+	}
+	return out, nil
+}
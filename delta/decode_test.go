@@ -0,0 +1,76 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodePaletted(t *testing.T) {
+	pal := testProfile.Palette
+	reversed := make(color.Palette, len(pal))
+	for i, c := range pal {
+		reversed[len(pal)-1-i] = c
+	}
+	unknown := color.RGBA{1, 2, 3, 0xff}
+
+	for _, tc := range []struct {
+		name string
+		src  color.Palette
+		pix  []uint8
+		// want is the index into pal of each pixel, or nil for an error
+		want []uint8
+	}{
+		{"same palette", pal, []uint8{0, 1, 2, 16}, []uint8{0, 1, 2, 16}},
+		// old frames index the colors from 0, without a transparent entry
+		{"offset palette", pal[1:], []uint8{0, 1, 2, 15}, []uint8{1, 2, 3, 16}},
+		{"reversed palette", reversed, []uint8{0, 1, 15, 16}, []uint8{16, 15, 1, 0}},
+		{"duplicate transparent entries", append(color.Palette{color.NRGBA{}, color.NRGBA{0xff, 0, 0, 0}}, pal[1:]...), []uint8{0, 1, 2, 3}, []uint8{0, 0, 1, 2}},
+		{"unused extra entries", append(append(color.Palette{}, pal...), unknown, color.RGBA{4, 5, 6, 0xff}), []uint8{1, 2, 3, 16}, []uint8{1, 2, 3, 16}},
+		{"unmapped color", append(append(color.Palette{}, pal...), unknown), []uint8{1, 2, 17, 3}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := image.NewPaletted(image.Rect(0, 0, 2, 2), tc.src)
+			copy(src.Pix, tc.pix)
+			im, err := DecodePaletted(bytes.NewReader(encodePNG(t, src)), pal)
+			if tc.want == nil {
+				var pe *PaletteError
+				if !errors.As(err, &pe) || pe.X != 0 || pe.Y != 1 || colorKey(pe.Color) != colorKey(unknown) {
+					t.Fatalf("err = %v, want a PaletteError at (0,1)", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(im.Palette) != len(pal) || &im.Palette[0] != &pal[0] {
+				t.Error("decoded image doesn't use the target palette")
+			}
+			if !bytes.Equal(im.Pix, tc.want) {
+				t.Errorf("pixels %v, want %v", im.Pix, tc.want)
+			}
+		})
+	}
+}
+
+func TestToPaletteRGBA(t *testing.T) {
+	pal := testProfile.Palette
+	src := image.NewRGBA(image.Rect(1, 1, 3, 2))
+	src.Set(1, 1, pal[3])
+	src.Set(2, 1, color.NRGBA{0x10, 0x20, 0x30, 0})
+	im, err := ToPalette(src, pal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.Rect != src.Rect || im.ColorIndexAt(1, 1) != 3 || im.ColorIndexAt(2, 1) != 0 {
+		t.Errorf("mapped to %v %v", im.Rect, im.Pix)
+	}
+
+	src.Set(2, 1, color.RGBA{1, 2, 3, 0xff})
+	var pe *PaletteError
+	if _, err := ToPalette(src, pal); !errors.As(err, &pe) || pe.X != 2 || pe.Y != 1 {
+		t.Errorf("err = %v, want a PaletteError at (2,1)", err)
+	}
+}
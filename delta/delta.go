@@ -1,103 +1,264 @@
 package delta
 
 import (
-	"archive/zip"
 	"errors"
+	"fmt"
 	"image"
-	"image/png"
+	"image/color"
+	"io"
+	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-)
+	"time"
 
-type SimpleCache[K comparable, V any] struct {
-	cap int
-	i   int
-	k   []K
-	m   map[K]V
-}
+	"github.com/rmmh/rplace/palette"
+	"github.com/rmmh/rplace/profile"
+)
 
-func NewSimpleCache[K comparable, V any](size int) *SimpleCache[K, V] {
-	return &SimpleCache[K, V]{
-		cap: size,
-		k:   make([]K, size),
-		m:   make(map[K]V),
-	}
-}
+// DeltaReaderEntry is one stored frame. Keyframes are complete images; every
+// other frame is a delta against its predecessor, which may itself be a
+// delta.
+type DeltaReaderEntry struct {
+	Ts, Canvas int
+	// Prev is the timestamp of the frame this one is a delta against, or 0
+	// for keyframes.
+	Prev int
+	// Base is the timestamp of the keyframe at the root of the delta chain,
+	// or 0 for keyframes.
+	Base int
+	// Depth is the number of deltas between this frame and its keyframe.
+	Depth int
+	Name  string
+	Store FrameStore
 
-func (s *SimpleCache[K, V]) Get(k K) (V, bool) {
-	v, ok := s.m[k]
-	return v, ok
+	pal color.Palette
+	// spdPal and remap are the palette a store's sparse deltas were written
+	// with and the table converting their indexes to pal, when it's an
+	// earlier version of pal.
+	spdPal *palette.Palette
+	remap  []uint8
+	// chain holds the predecessors named in the frame's file name, nearest
+	// first.
+	chain []int
 }
 
-func (s *SimpleCache[K, V]) Put(k K, v V) {
-	if len(s.m) >= s.cap {
-		delete(s.m, s.k[s.i])
-		s.i = (s.i + 1) % s.cap
+// Open returns the undecoded contents of the frame.
+func (d DeltaReaderEntry) Open() (io.ReadCloser, error) {
+	r, err := d.Store.Open(d.Name)
+	if err != nil {
+		return nil, err
 	}
-	s.k[(s.i+len(s.m))%s.cap] = k
-	s.m[k] = v
+	return countingReader{r}, nil
 }
 
-type DeltaReaderEntry struct {
-	Ts, Canvas  int
-	Base, Delta int
-	F           *zip.File
+// IsSparse reports whether the frame is stored as a sparse delta rather
+// than a PNG.
+func (d DeltaReaderEntry) IsSparse() bool {
+	return strings.HasSuffix(d.Name, SparseExt)
 }
 
+// Read decodes the frame onto the profile's palette. Deltas are returned
+// as stored, without their predecessors applied.
 func (d DeltaReaderEntry) Read() (*image.Paletted, error) {
-	r, err := d.F.Open()
+	if d.IsSparse() {
+		s, err := d.ReadSparse()
+		if err != nil {
+			return nil, err
+		}
+		return s.Paletted(d.pal), nil
+	}
+	r, err := d.Open()
+	if err != nil {
+		return nil, err
+	}
 	defer r.Close()
+	defer DecodeTime.since(time.Now())
+	im, err := DecodePaletted(r, d.pal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d.Name, err)
+	}
+	return im, nil
+}
+
+// ReadSparse reads the frame as a sparse delta, converting PNG frames.
+func (d DeltaReaderEntry) ReadSparse() (*Sparse, error) {
+	if !d.IsSparse() {
+		im, err := d.Read()
+		if err != nil {
+			return nil, err
+		}
+		return MakeSparse(im), nil
+	}
+	r, err := d.Open()
 	if err != nil {
 		return nil, err
 	}
-	im, err := png.Decode(r)
+	defer r.Close()
+	defer DecodeTime.since(time.Now())
+	pal := d.pal
+	if d.spdPal != nil {
+		pal = d.spdPal.Colors
+	}
+	s, err := DecodeSparse(r, pal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d.Name, err)
+	}
+	if d.remap != nil {
+		for _, run := range s.Runs {
+			palette.Apply(d.remap, run.Pix)
+		}
+	}
+	return s, nil
+}
+
+// applyTo returns base with delta frame e drawn over it, modifying base
+// itself if inPlace is set.
+func (d DeltaReaderEntry) applyTo(base *image.Paletted, inPlace bool) (*image.Paletted, error) {
+	if d.IsSparse() {
+		s, err := d.ReadSparse()
+		if err != nil {
+			return nil, err
+		}
+		defer ApplyTime.since(time.Now())
+		if !inPlace {
+			return ApplySparse(base, s)
+		}
+		return base, s.ApplyTo(base)
+	}
+	im, err := d.Read()
 	if err != nil {
 		return nil, err
 	}
-	return im.(*image.Paletted), nil
+	defer ApplyTime.since(time.Now())
+	if !inPlace {
+		return ApplyDelta(base, im)
+	}
+	return base, applyDeltaInPlace(base, im)
 }
 
 type DeltaReader struct {
-	fzip, dzip, tzip *zip.ReadCloser
-	Files            [6][]DeltaReaderEntry
-	FileMap          [6]map[int]DeltaReaderEntry
-	L                sync.Mutex
+	Profile *profile.Profile
+	stores  []FrameStore
+	Files   [][]DeltaReaderEntry
+	FileMap []map[int]DeltaReaderEntry
 
-	c *SimpleCache[int, *image.Paletted]
+	c *Cache[int, *image.Paletted]
 }
 
-func MakeDeltaReader(full, delta, ticks string) (*DeltaReader, error) {
-	fzip, err := zip.OpenReader(full)
-	if err != nil {
-		return nil, err
+// DefaultCacheBytes is the initial size bound of a DeltaReader's frame cache.
+const DefaultCacheBytes = 128 << 20
+
+func imageBytes(im *image.Paletted) int64 {
+	return int64(len(im.Pix)+4*len(im.Palette)) + 64
+}
+
+// Conflict is a canvas frame that was found in more than one frame store.
+type Conflict struct {
+	Ts, Canvas    int
+	First, Second string
+}
+
+// ConflictError is returned by NewDeltaReader when frame stores disagree
+// about which entry holds a frame.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	msg := fmt.Sprintf("%d conflicting frames", len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		if i == 10 {
+			msg += ", ..."
+			break
+		}
+		msg += fmt.Sprintf("; canvas %d ts %d in %s and %s", c.Canvas, c.Ts, c.First, c.Second)
 	}
-	var dzip, tzip *zip.ReadCloser
-	if delta != "" {
-		dzip, err = zip.OpenReader(delta)
+	return msg
+}
+
+// expandPaths turns a list of frame store paths and glob patterns into a
+// sorted, deduplicated list of paths. Empty entries are ignored, and a
+// pattern containing glob metacharacters may match nothing.
+func expandPaths(patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	var paths []string
+	for _, pat := range patterns {
+		if pat == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pat)
 		if err != nil {
 			return nil, err
 		}
+		if len(matches) == 0 && !strings.ContainsAny(pat, "*?[") {
+			matches = []string{pat}
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				paths = append(paths, m)
+			}
+		}
 	}
-	if ticks != "" {
-		tzip, err = zip.OpenReader(ticks)
+	return paths, nil
+}
+
+// MakeDeltaReader opens every full, delta and tick frame store matched by
+// paths and merges their entries. Each path may be a zip, a tar, a directory
+// of PNGs or a glob of them, such as "canvas_ticks.*.zip" for sharded tick
+// archives.
+func MakeDeltaReader(p *profile.Profile, paths ...string) (*DeltaReader, error) {
+	paths, err := expandPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no frame stores given")
+	}
+
+	var stores []FrameStore
+	for _, p := range paths {
+		s, err := OpenFrameStore(p)
 		if err != nil {
+			for _, s := range stores {
+				s.Close()
+			}
 			return nil, err
 		}
+		stores = append(stores, s)
 	}
 
-	d := &DeltaReader{fzip: fzip, dzip: dzip, tzip: tzip,
-		c: NewSimpleCache[int, *image.Paletted](128),
+	return NewDeltaReader(p, stores...)
+}
+
+// NewDeltaReader merges the entries of stores. The DeltaReader takes
+// ownership of the stores, closing them on error or on Close.
+func NewDeltaReader(p *profile.Profile, stores ...FrameStore) (*DeltaReader, error) {
+	d := &DeltaReader{
+		Profile: p,
+		stores:  stores,
+		Files:   make([][]DeltaReaderEntry, p.Canvases),
+		FileMap: make([]map[int]DeltaReaderEntry, p.Canvases),
+		c:       NewCache[int](DefaultCacheBytes, imageBytes),
 	}
 	for i := 0; i < len(d.FileMap); i++ {
 		d.FileMap[i] = make(map[int]DeltaReaderEntry)
 	}
 
-	addFile := func(f *zip.File) error {
-		comps := strings.Split(strings.TrimSuffix(f.Name, ".png"), "-")
+	source := map[int]string{}
+	var conflicts []Conflict
+
+	var spdPal *palette.Palette
+	var remap []uint8
+	addFile := func(store FrameStore, name string) error {
+		base := path.Base(name)
+		comps := strings.Split(strings.TrimSuffix(base, path.Ext(base)), "-")
 		if len(comps) < 2 {
-			return errors.New("unknown entry in zip file " + f.Name)
+			return errors.New("unknown frame " + name)
 		}
 		ts, err := strconv.Atoi(comps[0])
 		if err != nil {
@@ -107,55 +268,69 @@ func MakeDeltaReader(full, delta, ticks string) (*DeltaReader, error) {
 		if err != nil {
 			return err
 		}
+		if canvas < 0 || canvas >= len(d.Files) {
+			return fmt.Errorf("bad canvas %d in frame %s", canvas, name)
+		}
 		m := DeltaReaderEntry{
 			Ts:     ts,
 			Canvas: canvas,
-			F:      f,
+			Name:   name,
+			Store:  store,
+			pal:    d.Profile.Palette,
+			spdPal: spdPal,
+			remap:  remap,
 		}
-		if len(comps) == 4 {
-			m.Base, err = strconv.Atoi(comps[3])
-			if err != nil {
-				return err
-			}
-			m.Delta, err = strconv.Atoi(comps[2])
-			if err != nil {
-				return err
-			}
-		} else if len(comps) >= 3 {
-			m.Base, err = strconv.Atoi(comps[2])
+		for _, c := range comps[2:] {
+			prev, err := strconv.Atoi(c)
 			if err != nil {
 				return err
 			}
+			m.chain = append(m.chain, prev)
 		}
+		if len(m.chain) > 0 {
+			m.Prev = m.chain[0]
+		}
+		full := store.String() + ":" + name
+		if prev, ok := source[ts<<3+canvas]; ok {
+			conflicts = append(conflicts, Conflict{Ts: ts, Canvas: canvas, First: prev, Second: full})
+			return nil
+		}
+		source[ts<<3+canvas] = full
 		d.Files[canvas] = append(d.Files[canvas], m)
 		d.FileMap[canvas][ts] = m
 		return nil
 	}
 
-	for _, f := range fzip.File {
-		err = addFile(f)
+	for _, store := range stores {
+		var err error
+		spdPal, remap, err = storeRemap(store, p)
 		if err != nil {
+			d.Close()
 			return nil, err
 		}
-	}
-	if tzip != nil {
-		for _, f := range tzip.File {
-			err = addFile(f)
+		for _, name := range store.List() {
+			err := addFile(store, name)
 			if err != nil {
-				return nil, err
+				d.Close()
+				return nil, fmt.Errorf("%s: %w", store, err)
 			}
 		}
 	}
-	if dzip != nil {
-		for _, f := range dzip.File {
-			err = addFile(f)
-			if err != nil {
-				return nil, err
-			}
+
+	if len(conflicts) > 0 {
+		d.Close()
+		return nil, &ConflictError{Conflicts: conflicts}
+	}
+
+	for canvas := range d.FileMap {
+		err := d.linkChains(canvas)
+		if err != nil {
+			d.Close()
+			return nil, err
 		}
 	}
 
-	for n := 0; n < 4; n++ {
+	for n := range d.Files {
 		sort.Slice(d.Files[n], func(i, j int) bool {
 			return d.Files[n][i].Ts < d.Files[n][j].Ts
 		})
@@ -164,6 +339,119 @@ func MakeDeltaReader(full, delta, ticks string) (*DeltaReader, error) {
 	return d, nil
 }
 
+// storeRemap returns the palette of a store's sparse deltas and the table
+// converting their indexes to the profile's palette, or nils if they already
+// use it. A store may use an earlier version of the profile's palette, since
+// 2022's grew mid-event; PNG frames carry their colors, so only sparse deltas
+// need converting.
+func storeRemap(store FrameStore, p *profile.Profile) (*palette.Palette, []uint8, error) {
+	name := store.Palette()
+	if name == "" || name == p.Pal.Name {
+		return nil, nil, nil
+	}
+	sp, err := palette.Lookup(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", store, err)
+	}
+	if sp.Event != p.Pal.Event || sp.Since > p.Pal.Since {
+		return nil, nil, fmt.Errorf("%s: frames use palette %s, not %s", store, name, p.Pal.Name)
+	}
+	table, err := palette.Remap(sp, p.Pal)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", store, err)
+	}
+	return sp, table, nil
+}
+
+var (
+	ErrMissingLink = errors.New("missing delta predecessor")
+	ErrChainCycle  = errors.New("delta chain cycle")
+	ErrWrongSize   = errors.New("applying delta onto wrong-sized base")
+)
+
+// linkChains resolves the delta chain of every frame on a canvas, filling in
+// Base and Depth. The predecessors listed in a frame's name must match the
+// frames actually found by following Prev.
+func (d *DeltaReader) linkChains(canvas int) error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	fm := d.FileMap[canvas]
+	state := make(map[int]int, len(fm))
+
+	var link func(ts int) error
+	link = func(ts int) error {
+		switch state[ts] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("canvas %d frame %s: %w", canvas, fm[ts].Name, ErrChainCycle)
+		}
+		state[ts] = visiting
+		e := fm[ts]
+		if e.Prev != 0 {
+			p, ok := fm[e.Prev]
+			if !ok {
+				return fmt.Errorf("canvas %d frame %s: %w %d", canvas, e.Name, ErrMissingLink, e.Prev)
+			}
+			if err := link(e.Prev); err != nil {
+				return err
+			}
+			p = fm[e.Prev]
+			e.Depth = p.Depth + 1
+			e.Base = p.Base
+			if p.Prev == 0 {
+				e.Base = p.Ts
+			}
+			// the rest of the named chain must agree with the predecessor's
+			a := p
+			for _, want := range e.chain[1:] {
+				if a.Prev != want {
+					return fmt.Errorf("canvas %d frame %s: %w %d (chain has %d)", canvas, e.Name, ErrMissingLink, want, a.Prev)
+				}
+				a = fm[a.Prev]
+			}
+		}
+		fm[ts] = e
+		state[ts] = done
+		return nil
+	}
+
+	for ts := range fm {
+		if err := link(ts); err != nil {
+			return err
+		}
+	}
+	for i, e := range d.Files[canvas] {
+		d.Files[canvas][i] = fm[e.Ts]
+	}
+	return nil
+}
+
+// Chain returns the timestamps of e's predecessors, nearest first and ending
+// with its keyframe.
+func (d *DeltaReader) Chain(e *DeltaReaderEntry) []int {
+	chain := make([]int, 0, e.Depth)
+	for p := e.Prev; p != 0; p = d.FileMap[e.Canvas][p].Prev {
+		chain = append(chain, p)
+	}
+	return chain
+}
+
+// Close closes every frame store the DeltaReader reads from.
+func (d *DeltaReader) Close() error {
+	var err error
+	for _, s := range d.stores {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	d.stores = nil
+	return err
+}
+
 func (d *DeltaReader) FindNearest(ts, quad int) *DeltaReaderEntry {
 	fs := d.Files[quad]
 	ind := sort.Search(len(fs), func(i int) bool {
@@ -192,50 +480,41 @@ func (d *DeltaReader) FindNearestLeft(ts, quad int) *DeltaReaderEntry {
 	return &fs[ind]
 }
 
-func (d *DeltaReader) GetImageRaw(e DeltaReaderEntry) (*image.Paletted, error) {
-	// lock must be held
-	k := e.Ts<<2 + e.Canvas
-	im, ok := d.c.Get(k)
-	if ok {
-		return im, nil
-	}
-
-	im, err := e.Read()
-	if err != nil {
-		return nil, err
-	}
+// SetCacheLimit bounds the memory used by cached intermediate frames.
+func (d *DeltaReader) SetCacheLimit(bytes int64) {
+	d.c.SetLimit(bytes)
+}
 
-	d.c.Put(k, im)
+func (d *DeltaReader) CacheStats() CacheStats {
+	return d.c.Stats()
+}
 
-	return im, nil
+// getResolved returns frame e with its delta chain applied, caching it and
+// every intermediate frame.
+func (d *DeltaReader) getResolved(e DeltaReaderEntry) (*image.Paletted, error) {
+	return d.c.Load(e.Ts<<3+e.Canvas, func() (*image.Paletted, error) {
+		if e.Prev == 0 {
+			return e.Read()
+		}
+		b, err := d.getResolved(d.FileMap[e.Canvas][e.Prev])
+		if err != nil {
+			return nil, err
+		}
+		return e.applyTo(b, false)
+	})
 }
 
-// GetImage gets an image with deltas applied.
+// GetImage gets an image with deltas applied. It is safe to call
+// concurrently, and the returned image is owned by the caller.
 func (d *DeltaReader) GetImage(e *DeltaReaderEntry) (*image.Paletted, error) {
-	d.L.Lock()
-	defer d.L.Unlock()
-
-	im, err := e.Read()
+	if e.Prev == 0 {
+		return e.Read()
+	}
+	b, err := d.getResolved(d.FileMap[e.Canvas][e.Prev])
 	if err != nil {
 		return nil, err
 	}
-
-	if e.Base != 0 {
-		b, err := d.GetImageRaw(d.FileMap[e.Canvas][e.Base])
-		if err != nil {
-			return nil, err
-		}
-		if e.Delta != 0 {
-			d, err := d.GetImageRaw(d.FileMap[e.Canvas][e.Delta])
-			if err != nil {
-				return nil, err
-			}
-			b = ApplyDelta(b, d)
-		}
-		im = ApplyDelta(b, im)
-	}
-
-	return im, nil
+	return e.applyTo(b, false)
 }
 
 var imagePool sync.Pool
@@ -244,25 +523,20 @@ func FreeImage(i *image.Paletted) {
 	imagePool.Put(i)
 }
 
-func ApplyDelta(base, delta *image.Paletted) *image.Paletted {
+// ApplyDelta returns base with every non-transparent pixel of delta drawn
+// over it. Both images must use the same palette, with transparency at
+// index 0; DecodePaletted produces such images. ApplySparse does the same for
+// sparse deltas.
+func ApplyDelta(base, delta *image.Paletted) (*image.Paletted, error) {
 	if !base.Rect.Eq(delta.Rect) {
-		panic("applying delta onto wrong-sized base")
+		return nil, ErrWrongSize
 	}
 	combined := image.NewPaletted(base.Rect, base.Palette)
 	copy(combined.Pix, base.Pix)
-	if len(delta.Palette) == len(base.Palette) {
-		for i, ci := range delta.Pix {
-			if ci > 0 {
-				combined.Pix[i] = ci
-			}
-		}
-	} else {
-		// old style
-		for i := 0; i < len(delta.Pix); i++ {
-			if ci := delta.Pix[i]; ci > 0 {
-				combined.Pix[i] = ci - 1
-			}
+	for i, ci := range delta.Pix {
+		if ci > 0 {
+			combined.Pix[i] = ci
 		}
 	}
-	return combined
+	return combined, nil
 }
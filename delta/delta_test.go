@@ -0,0 +1,87 @@
+package delta
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeltaChains(t *testing.T) {
+	dir := writeDir(t, map[string][]byte{
+		"100-0.png":         encodePNG(t, testFrame(1, nil)),
+		"200-0-100.png":     encodePNG(t, testFrame(0, map[int]uint8{0: 2})),
+		"300-0-200-100.png": encodePNG(t, testFrame(0, map[int]uint8{1: 3})),
+		"400-0-300.png":     encodePNG(t, testFrame(0, map[int]uint8{0: 4})),
+	})
+	d, err := MakeDeltaReader(testProfile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, tc := range []struct {
+		ts, depth, base int
+		chain           []int
+		pix             map[int]uint8
+	}{
+		{100, 0, 0, nil, map[int]uint8{0: 1, 1: 1}},
+		{200, 1, 100, []int{100}, map[int]uint8{0: 2, 1: 1}},
+		{300, 2, 100, []int{200, 100}, map[int]uint8{0: 2, 1: 3}},
+		{400, 3, 100, []int{300, 200, 100}, map[int]uint8{0: 4, 1: 3}},
+	} {
+		e := d.FileMap[0][tc.ts]
+		if e.Depth != tc.depth || e.Base != tc.base {
+			t.Errorf("%d: depth %d base %d, want %d and %d", tc.ts, e.Depth, e.Base, tc.depth, tc.base)
+		}
+		if chain := d.Chain(&e); len(chain) != len(tc.chain) {
+			t.Errorf("%d: chain %v, want %v", tc.ts, chain, tc.chain)
+		} else {
+			for i := range chain {
+				if chain[i] != tc.chain[i] {
+					t.Errorf("%d: chain %v, want %v", tc.ts, chain, tc.chain)
+					break
+				}
+			}
+		}
+		im, err := d.GetImage(&e)
+		if err != nil {
+			t.Fatalf("%d: %v", tc.ts, err)
+		}
+		for o, want := range tc.pix {
+			if im.Pix[o] != want {
+				t.Errorf("%d: pixel %d = %d, want %d", tc.ts, o, im.Pix[o], want)
+			}
+		}
+	}
+}
+
+func TestDeltaChainErrors(t *testing.T) {
+	key := encodePNG(t, testFrame(1, nil))
+	dlt := encodePNG(t, testFrame(0, map[int]uint8{0: 2}))
+	for _, tc := range []struct {
+		name  string
+		files map[string][]byte
+		want  error
+	}{
+		{"missing predecessor", map[string][]byte{"100-0.png": key, "300-0-200.png": dlt}, ErrMissingLink},
+		{"chain disagrees", map[string][]byte{"100-0.png": key, "200-0-100.png": dlt, "300-0-200-50.png": dlt}, ErrMissingLink},
+		{"cycle", map[string][]byte{"100-0-200.png": dlt, "200-0-100.png": dlt}, ErrChainCycle},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := MakeDeltaReader(testProfile, writeDir(t, tc.files))
+			if !errors.Is(err, tc.want) {
+				t.Errorf("err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeltaReaderConflicts(t *testing.T) {
+	key := encodePNG(t, testFrame(1, nil))
+	a := writeDir(t, map[string][]byte{"100-0.png": key})
+	b := writeDir(t, map[string][]byte{"100-0.png": key})
+	_, err := MakeDeltaReader(testProfile, a, b)
+	var ce *ConflictError
+	if !errors.As(err, &ce) || len(ce.Conflicts) != 1 {
+		t.Errorf("err = %v, want one conflict", err)
+	}
+}
@@ -0,0 +1,119 @@
+package delta
+
+import (
+	"context"
+	"image"
+	"sort"
+)
+
+// Frame is a reconstructed frame yielded by a FrameIterator.
+type Frame struct {
+	Entry *DeltaReaderEntry
+	Image *image.Paletted
+}
+
+// FrameIterator walks frames in timestamp order, applying each delta to the
+// previous frame of its canvas when that frame is its predecessor instead of
+// rebuilding it from its keyframe.
+type FrameIterator struct {
+	d    *DeltaReader
+	ctx  context.Context
+	ents []*DeltaReaderEntry
+	i    int
+
+	// the last frame yielded for each canvas, owned by the iterator
+	lastTs []int
+	lastIm []*image.Paletted
+
+	cur Frame
+	err error
+}
+
+// Frames iterates over the frames with from <= Ts <= to of the given
+// canvases, or of every canvas if none are given. A to of 0 or less means no
+// upper bound. Frames with equal timestamps are yielded in canvas order.
+func (d *DeltaReader) Frames(ctx context.Context, from, to int, canvases ...int) *FrameIterator {
+	if len(canvases) == 0 {
+		for c := range d.Files {
+			canvases = append(canvases, c)
+		}
+	}
+	it := &FrameIterator{
+		d:      d,
+		ctx:    ctx,
+		lastTs: make([]int, len(d.Files)),
+		lastIm: make([]*image.Paletted, len(d.Files)),
+	}
+	for _, c := range canvases {
+		fs := d.Files[c]
+		i := sort.Search(len(fs), func(i int) bool { return fs[i].Ts >= from })
+		for ; i < len(fs) && (to <= 0 || fs[i].Ts <= to); i++ {
+			it.ents = append(it.ents, &fs[i])
+		}
+	}
+	sort.SliceStable(it.ents, func(i, j int) bool {
+		if it.ents[i].Ts != it.ents[j].Ts {
+			return it.ents[i].Ts < it.ents[j].Ts
+		}
+		return it.ents[i].Canvas < it.ents[j].Canvas
+	})
+	return it
+}
+
+// Len is the total number of frames the iterator yields.
+func (it *FrameIterator) Len() int {
+	return len(it.ents)
+}
+
+// Next reconstructs the next frame, returning false at the end, on error or
+// once the context is cancelled.
+func (it *FrameIterator) Next() bool {
+	if it.err != nil || it.i >= len(it.ents) {
+		return false
+	}
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	e := it.ents[it.i]
+	it.i++
+
+	c := e.Canvas
+	var im *image.Paletted
+	if last := it.lastIm[c]; last != nil && e.Prev != 0 && e.Prev == it.lastTs[c] {
+		im, it.err = e.applyTo(last, true)
+		if it.err != nil {
+			return false
+		}
+	} else {
+		im, it.err = it.d.GetImage(e)
+		if it.err != nil {
+			return false
+		}
+	}
+	it.lastTs[c] = e.Ts
+	it.lastIm[c] = im
+	it.cur = Frame{Entry: e, Image: im}
+	return true
+}
+
+// Frame returns the current frame. Its image is reused by later calls to
+// Next, so callers must copy it to keep it.
+func (it *FrameIterator) Frame() Frame {
+	return it.cur
+}
+
+func (it *FrameIterator) Err() error {
+	return it.err
+}
+
+func applyDeltaInPlace(dst, delta *image.Paletted) error {
+	if !dst.Rect.Eq(delta.Rect) {
+		return ErrWrongSize
+	}
+	for i, ci := range delta.Pix {
+		if ci > 0 {
+			dst.Pix[i] = ci
+		}
+	}
+	return nil
+}
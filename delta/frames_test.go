@@ -0,0 +1,104 @@
+package delta
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"path/filepath"
+	"testing"
+
+	"github.com/rmmh/rplace/profile"
+)
+
+// wideProfile is two 4x4 canvases side by side.
+var wideProfile = func() *profile.Profile {
+	p := *testProfile
+	p.Canvases = 2
+	p.Offsets = []image.Point{{0, 0}, {4, 0}}
+	return &p
+}()
+
+// testFrames is a delta chain on canvas 0 and two keyframes on canvas 1.
+func testFrames(t *testing.T) map[string][]byte {
+	return map[string][]byte{
+		"100-0.png":     encodePNG(t, testFrame(1, nil)),
+		"200-0-100.png": encodePNG(t, testFrame(0, map[int]uint8{0: 2})),
+		"300-0-200.png": encodePNG(t, testFrame(0, map[int]uint8{1: 3})),
+		"150-1.png":     encodePNG(t, testFrame(4, map[int]uint8{5: 6})),
+		"300-1.png":     encodePNG(t, testFrame(5, nil)),
+	}
+}
+
+// writeZip writes frames into a zip, storing any hashes as comments, and
+// opens a reader on it.
+func writeZip(t *testing.T, p *profile.Profile, frames map[string][]byte, hashes map[string]string) *DeltaReader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, b := range frames {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Comment: hashes[name]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b)
+	}
+	zw.SetComment(PaletteComment("2017"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(writeDir(t, map[string][]byte{"frames.zip": buf.Bytes()}), "frames.zip")
+	d, err := MakeDeltaReader(p, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestFrames(t *testing.T) {
+	d := writeZip(t, wideProfile, testFrames(t), nil)
+
+	for _, tc := range []struct {
+		name     string
+		from, to int
+		canvases []int
+		// want is ts/canvas and the first two pixels of each frame
+		want []string
+	}{
+		{"all", 0, 0, nil, []string{"100/0 [1 1]", "150/1 [4 4]", "200/0 [2 1]", "300/0 [2 3]", "300/1 [5 5]"}},
+		{"range", 150, 250, nil, []string{"150/1 [4 4]", "200/0 [2 1]"}},
+		{"one canvas", 200, 0, []int{0}, []string{"200/0 [2 1]", "300/0 [2 3]"}},
+		{"inclusive", 300, 300, []int{1, 0}, []string{"300/0 [2 3]", "300/1 [5 5]"}},
+		{"empty", 400, 0, nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			it := d.Frames(context.Background(), tc.from, tc.to, tc.canvases...)
+			if it.Len() != len(tc.want) {
+				t.Errorf("Len = %d, want %d", it.Len(), len(tc.want))
+			}
+			var got []string
+			for it.Next() {
+				f := it.Frame()
+				got = append(got, fmt.Sprintf("%d/%d %v", f.Entry.Ts, f.Entry.Canvas, f.Image.Pix[:2]))
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("frames %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it := d.Frames(ctx, 0, 0)
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	cancel()
+	if it.Next() || it.Err() != context.Canceled {
+		t.Errorf("Next after cancel: err %v, want %v", it.Err(), context.Canceled)
+	}
+}
@@ -0,0 +1,191 @@
+package delta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// SparseExt is the file extension of sparse deltas. Frame stores may hold
+// them next to PNG frames.
+const SparseExt = ".spd"
+
+const sparseMagic = "SPD1"
+
+// Sparse is a delta stored as runs of changed pixels, which is much smaller
+// and faster to apply than a mostly transparent image.
+type Sparse struct {
+	Rect image.Rectangle
+	Runs []Run
+}
+
+// Run is a span of changed pixels starting at offset Off of the image's Pix.
+type Run struct {
+	Off int
+	Pix []uint8
+}
+
+// Changed is the number of pixels the delta sets.
+func (s *Sparse) Changed() int {
+	n := 0
+	for _, r := range s.Runs {
+		n += len(r.Pix)
+	}
+	return n
+}
+
+// MakeSparse converts a delta image, where index 0 marks unchanged pixels,
+// into runs.
+func MakeSparse(delta *image.Paletted) *Sparse {
+	s := &Sparse{Rect: delta.Rect}
+	w, h := delta.Rect.Dx(), delta.Rect.Dy()
+	for y := 0; y < h; y++ {
+		row := delta.Pix[y*delta.Stride : y*delta.Stride+w]
+		for x := 0; x < w; {
+			if row[x] == 0 {
+				x++
+				continue
+			}
+			start := x
+			for x < w && row[x] != 0 {
+				x++
+			}
+			off := y*w + start
+			// join runs that continue from the end of the previous row
+			if n := len(s.Runs); n > 0 && s.Runs[n-1].Off+len(s.Runs[n-1].Pix) == off {
+				s.Runs[n-1].Pix = append(s.Runs[n-1].Pix, row[start:x]...)
+			} else {
+				s.Runs = append(s.Runs, Run{Off: off, Pix: append([]uint8(nil), row[start:x]...)})
+			}
+		}
+	}
+	return s
+}
+
+// Paletted expands the delta into an image with index 0 at unchanged pixels.
+func (s *Sparse) Paletted(pal color.Palette) *image.Paletted {
+	im := image.NewPaletted(s.Rect, pal)
+	s.ApplyTo(im)
+	return im
+}
+
+// ApplyTo draws the delta onto dst in place.
+func (s *Sparse) ApplyTo(dst *image.Paletted) error {
+	if !dst.Rect.Eq(s.Rect) {
+		return ErrWrongSize
+	}
+	w := s.Rect.Dx()
+	if dst.Stride == w {
+		for _, r := range s.Runs {
+			copy(dst.Pix[r.Off:], r.Pix)
+		}
+		return nil
+	}
+	for _, r := range s.Runs {
+		for i, ci := range r.Pix {
+			o := r.Off + i
+			dst.Pix[o/w*dst.Stride+o%w] = ci
+		}
+	}
+	return nil
+}
+
+// ApplySparse returns a copy of base with s drawn over it.
+func ApplySparse(base *image.Paletted, s *Sparse) (*image.Paletted, error) {
+	if !base.Rect.Eq(s.Rect) {
+		return nil, ErrWrongSize
+	}
+	combined := image.NewPaletted(base.Rect, base.Palette)
+	copy(combined.Pix, base.Pix)
+	return combined, s.ApplyTo(combined)
+}
+
+// EncodeSparse writes s as the magic "SPD1", then uvarints for the width,
+// height and run count, then each run as a uvarint gap since the end of the
+// previous run, a uvarint length and that many palette indexes.
+func EncodeSparse(w io.Writer, s *Sparse) error {
+	bw := bufio.NewWriter(w)
+	var buf [binary.MaxVarintLen64]byte
+	putUvarint := func(x int) {
+		n := binary.PutUvarint(buf[:], uint64(x))
+		bw.Write(buf[:n])
+	}
+	bw.WriteString(sparseMagic)
+	putUvarint(s.Rect.Dx())
+	putUvarint(s.Rect.Dy())
+	putUvarint(len(s.Runs))
+	end := 0
+	for _, r := range s.Runs {
+		putUvarint(r.Off - end)
+		putUvarint(len(r.Pix))
+		bw.Write(r.Pix)
+		end = r.Off + len(r.Pix)
+	}
+	return bw.Flush()
+}
+
+var errBadSparse = errors.New("malformed sparse delta")
+
+// maxSparseSide bounds the width and height DecodeSparse accepts.
+const maxSparseSide = 1 << 16
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// DecodeSparse reads a delta written by EncodeSparse, checking that every
+// index is a color of pal.
+func DecodeSparse(r io.Reader, pal color.Palette) (*Sparse, error) {
+	br := bufio.NewReader(r)
+	var magic [len(sparseMagic)]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil || string(magic[:]) != sparseMagic {
+		return nil, errBadSparse
+	}
+	var hdr [3]uint64
+	for i := range hdr {
+		v, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, errBadSparse
+		}
+		hdr[i] = v
+	}
+	if hdr[0] > maxSparseSide || hdr[1] > maxSparseSide || hdr[2] > hdr[0]*hdr[1] {
+		return nil, errBadSparse
+	}
+	w, h := int(hdr[0]), int(hdr[1])
+	size := w * h
+	// the run count isn't trusted to size the allocation until runs are read
+	runs := int(hdr[2])
+	s := &Sparse{Rect: image.Rect(0, 0, w, h), Runs: make([]Run, 0, minInt(runs, 1<<16))}
+	end := 0
+	for i := 0; i < runs; i++ {
+		gap, err := binary.ReadUvarint(br)
+		if err != nil || gap > uint64(size-end) {
+			return nil, errBadSparse
+		}
+		n, err := binary.ReadUvarint(br)
+		if err != nil || n > uint64(size-end)-gap {
+			return nil, errBadSparse
+		}
+		r := Run{Off: end + int(gap), Pix: make([]uint8, n)}
+		if _, err := io.ReadFull(br, r.Pix); err != nil {
+			return nil, errBadSparse
+		}
+		for j, ci := range r.Pix {
+			if ci == 0 || int(ci) >= len(pal) {
+				o := r.Off + j
+				return nil, fmt.Errorf("sparse delta pixel (%d,%d) has bad color index %d", o%w, o/w, ci)
+			}
+		}
+		s.Runs = append(s.Runs, r)
+		end = r.Off + int(n)
+	}
+	return s, nil
+}
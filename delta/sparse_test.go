@@ -0,0 +1,104 @@
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+func sparseRoundTrip(t *testing.T, im *image.Paletted) *Sparse {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := EncodeSparse(&buf, MakeSparse(im)); err != nil {
+		t.Fatal(err)
+	}
+	s, err := DecodeSparse(&buf, testProfile.Palette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Paletted(im.Palette); !bytes.Equal(got.Pix, im.Pix) {
+		t.Error("decoded delta differs from the encoded one")
+	}
+	return s
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		w, h  int
+		set   func(x, y int) uint8
+		runs  int
+		pixel int
+	}{
+		{"empty", 4, 4, func(x, y int) uint8 { return 0 }, 0, 0},
+		{"full", 4, 4, func(x, y int) uint8 { return 2 }, 1, 16},
+		// runs reaching the end of a row join the next row's
+		{"row ends", 4, 2, func(x, y int) uint8 {
+			if (y == 0 && x >= 2) || (y == 1 && x < 1) {
+				return 3
+			}
+			return 0
+		}, 1, 3},
+		// more runs than fit in 16 bits
+		{"stripes", 1000, 1000, func(x, y int) uint8 {
+			if x%2 == 0 {
+				return uint8(1 + (x+y)%16)
+			}
+			return 0
+		}, 500000, 500000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			im := image.NewPaletted(image.Rect(0, 0, tc.w, tc.h), testProfile.Palette)
+			for y := 0; y < tc.h; y++ {
+				for x := 0; x < tc.w; x++ {
+					im.Pix[y*im.Stride+x] = tc.set(x, y)
+				}
+			}
+			s := sparseRoundTrip(t, im)
+			if len(s.Runs) != tc.runs || s.Changed() != tc.pixel {
+				t.Errorf("%d runs and %d pixels, want %d and %d", len(s.Runs), s.Changed(), tc.runs, tc.pixel)
+			}
+		})
+	}
+}
+
+func TestSparseApplyToSubimage(t *testing.T) {
+	s := &Sparse{Rect: image.Rect(0, 0, 2, 2), Runs: []Run{{Off: 1, Pix: []uint8{4, 5}}}}
+	big := image.NewPaletted(image.Rect(0, 0, 4, 4), testProfile.Palette)
+	sub := big.SubImage(image.Rect(0, 0, 2, 2)).(*image.Paletted)
+	if err := s.ApplyTo(sub); err != nil {
+		t.Fatal(err)
+	}
+	if big.Pix[1] != 4 || big.Pix[4] != 5 || big.Pix[2] != 0 {
+		t.Errorf("applied onto a subimage as %v", big.Pix[:8])
+	}
+}
+
+func TestDecodeSparseMalformed(t *testing.T) {
+	enc := func(vals ...uint64) []byte {
+		b := []byte(sparseMagic)
+		for _, v := range vals {
+			b = binary.AppendUvarint(b, v)
+		}
+		return b
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"bad magic", append([]byte("SPD0"), enc(1, 1, 0)[4:]...)},
+		{"truncated header", enc(4, 4)},
+		{"too wide", enc(maxSparseSide+1, 1, 0)},
+		{"more runs than pixels", enc(2, 2, 5)},
+		{"run past the end", append(enc(2, 2, 1, 3, 2), 1, 1)},
+		{"truncated run", append(enc(2, 2, 1, 0, 3), 1)},
+		{"missing runs", append(enc(2, 2, 2, 0, 1), 1)},
+		{"transparent index", append(enc(2, 2, 1, 0, 1), 0)},
+		{"index past the palette", append(enc(2, 2, 1, 0, 1), 200)},
+	} {
+		if _, err := DecodeSparse(bytes.NewReader(tc.data), testProfile.Palette); err == nil {
+			t.Errorf("%s: decoded without error", tc.name)
+		}
+	}
+}
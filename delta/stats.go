@@ -0,0 +1,40 @@
+package delta
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Timing accumulates how many times an operation ran and for how long.
+type Timing struct {
+	n, nanos atomic.Int64
+}
+
+func (t *Timing) since(start time.Time) {
+	t.n.Add(1)
+	t.nanos.Add(int64(time.Since(start)))
+}
+
+func (t *Timing) Count() int64         { return t.n.Load() }
+func (t *Timing) Total() time.Duration { return time.Duration(t.nanos.Load()) }
+
+// Counters for the work done reading frames, summed over every DeltaReader.
+var (
+	// DecodeTime covers decoding stored frames, PNG or sparse.
+	DecodeTime Timing
+	// ApplyTime covers drawing deltas onto their base frames.
+	ApplyTime Timing
+	// BytesRead counts the undecoded bytes read from frame stores.
+	BytesRead atomic.Int64
+)
+
+type countingReader struct {
+	io.ReadCloser
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	BytesRead.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,265 @@
+package delta
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FrameStore is a collection of frame files named
+// {ts}-{canvas}[-{delta}]-{base}.png, or .spd for sparse deltas, such as a
+// zip archive, a tar file or a plain directory.
+type FrameStore interface {
+	// List returns the names of every frame in the store.
+	List() []string
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (fs.FileInfo, error)
+	// Hash returns the stored ImageHash of the fully reconstructed frame,
+	// or "" if the store doesn't have one.
+	Hash(name string) string
+	// Palette returns the name of the palette version the frames were
+	// written with, or "" if the store doesn't record it.
+	Palette() string
+	Close() error
+	String() string
+}
+
+// ManifestName is the file in directory and tar stores that holds frame
+// hashes, one "name hash" pair per line, and optionally a PaletteComment line.
+// Zip archives keep each frame's hash in its entry comment and the palette in
+// the archive comment instead.
+const ManifestName = "manifest.txt"
+
+// PaletteComment is the zip archive comment, or manifest line, recording the
+// palette version a store's frames were written with.
+func PaletteComment(name string) string {
+	return "palette=" + name
+}
+
+func readManifest(r io.Reader) (hashes map[string]string, pal string, err error) {
+	hashes = make(map[string]string)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 && strings.HasPrefix(fields[0], "palette=") {
+			pal = strings.TrimPrefix(fields[0], "palette=")
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, "", fmt.Errorf("bad manifest line %q", s.Text())
+		}
+		hashes[fields[0]] = fields[1]
+	}
+	return hashes, pal, s.Err()
+}
+
+// OpenFrameStore opens a directory, a .tar file or a .zip file as a
+// FrameStore.
+func OpenFrameStore(path string) (FrameStore, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		return OpenDirStore(path)
+	}
+	if strings.HasSuffix(path, ".tar") {
+		return OpenTarStore(path)
+	}
+	return OpenZipStore(path)
+}
+
+type zipStore struct {
+	path  string
+	r     *zip.ReadCloser
+	names []string
+	files map[string]*zip.File
+}
+
+// OpenZipStore opens a zip archive of frames.
+func OpenZipStore(p string) (FrameStore, error) {
+	r, err := zip.OpenReader(p)
+	if err != nil {
+		return nil, err
+	}
+	s := &zipStore{path: p, r: r, files: make(map[string]*zip.File)}
+	for _, f := range r.File {
+		if f.Mode().IsDir() || path.Base(f.Name) == ManifestName {
+			continue
+		}
+		s.names = append(s.names, f.Name)
+		s.files[f.Name] = f
+	}
+	return s, nil
+}
+
+func (s *zipStore) List() []string { return s.names }
+func (s *zipStore) Close() error   { return s.r.Close() }
+func (s *zipStore) String() string { return s.path }
+
+func (s *zipStore) Palette() string {
+	if !strings.HasPrefix(s.r.Comment, "palette=") {
+		return ""
+	}
+	return strings.TrimPrefix(s.r.Comment, "palette=")
+}
+
+func (s *zipStore) Hash(name string) string {
+	if f, ok := s.files[name]; ok {
+		return f.Comment
+	}
+	return ""
+}
+
+func (s *zipStore) Open(name string) (io.ReadCloser, error) {
+	f, ok := s.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.Open()
+}
+
+func (s *zipStore) Stat(name string) (fs.FileInfo, error) {
+	f, ok := s.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.FileInfo(), nil
+}
+
+type dirStore struct {
+	path   string
+	names  []string
+	hashes map[string]string
+	pal    string
+}
+
+// OpenDirStore opens a directory of loose frame files. Files that don't end
+// in .png or .spd are ignored.
+func OpenDirStore(path string) (FrameStore, error) {
+	ents, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &dirStore{path: path}
+	for _, e := range ents {
+		if e.Type().IsRegular() && (strings.HasSuffix(e.Name(), ".png") || strings.HasSuffix(e.Name(), SparseExt)) {
+			s.names = append(s.names, e.Name())
+		}
+	}
+	sort.Strings(s.names)
+	f, err := os.Open(filepath.Join(path, ManifestName))
+	if err == nil {
+		s.hashes, s.pal, err = readManifest(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *dirStore) List() []string          { return s.names }
+func (s *dirStore) Hash(name string) string { return s.hashes[name] }
+func (s *dirStore) Palette() string         { return s.pal }
+func (s *dirStore) Close() error            { return nil }
+func (s *dirStore) String() string          { return s.path }
+
+func (s *dirStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.path, name))
+}
+
+func (s *dirStore) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(filepath.Join(s.path, name))
+}
+
+type tarEntry struct {
+	hdr *tar.Header
+	off int64
+}
+
+type tarStore struct {
+	path   string
+	f      *os.File
+	names  []string
+	ents   map[string]tarEntry
+	hashes map[string]string
+	pal    string
+}
+
+// OpenTarStore indexes an uncompressed tar file. Entries are read in place,
+// so compressed tars must be unpacked first.
+func OpenTarStore(p string) (FrameStore, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	s := &tarStore{path: p, f: f, ents: make(map[string]tarEntry)}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// tar.Reader doesn't buffer, so the file offset is the start of
+		// this entry's contents.
+		off, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		s.ents[hdr.Name] = tarEntry{hdr: hdr, off: off}
+		if path.Base(hdr.Name) == ManifestName {
+			s.hashes, s.pal, err = readManifest(tr)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			continue
+		}
+		s.names = append(s.names, hdr.Name)
+	}
+	return s, nil
+}
+
+func (s *tarStore) List() []string          { return s.names }
+func (s *tarStore) Hash(name string) string { return s.hashes[name] }
+func (s *tarStore) Palette() string         { return s.pal }
+func (s *tarStore) Close() error            { return s.f.Close() }
+func (s *tarStore) String() string          { return s.path }
+
+func (s *tarStore) Open(name string) (io.ReadCloser, error) {
+	e, ok := s.ents[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(io.NewSectionReader(s.f, e.off, e.hdr.Size)), nil
+}
+
+func (s *tarStore) Stat(name string) (fs.FileInfo, error) {
+	e, ok := s.ents[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return e.hdr.FileInfo(), nil
+}
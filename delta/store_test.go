@@ -0,0 +1,191 @@
+package delta
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rmmh/rplace/palette"
+	"github.com/rmmh/rplace/profile"
+)
+
+// testProfile is a single 4x4 canvas with the 2017 palette.
+var testProfile = &profile.Profile{
+	Name:     "test",
+	Canvases: 1, TileWidth: 4, TileHeight: 4,
+	Offsets: []image.Point{{0, 0}},
+	Pal:     palette.Palette2017,
+	Palette: palette.Palette2017.Colors,
+	Blank:   1,
+}
+
+// testFrame returns a 4x4 frame with pixels set to the given colors, by
+// offset into Pix.
+func testFrame(fill uint8, set map[int]uint8) *image.Paletted {
+	im := image.NewPaletted(image.Rect(0, 0, 4, 4), testProfile.Palette)
+	for i := range im.Pix {
+		im.Pix[i] = fill
+	}
+	for o, c := range set {
+		im.Pix[o] = c
+	}
+	return im
+}
+
+func encodePNG(t *testing.T, im image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, im); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeDir writes files into a new directory and returns its path.
+func writeDir(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFrameStores(t *testing.T) {
+	frames := map[string][]byte{
+		"100-0.png":     encodePNG(t, testFrame(1, nil)),
+		"200-0-100.png": encodePNG(t, testFrame(0, map[int]uint8{5: 3})),
+	}
+	hashes := map[string]string{"100-0.png": "h100", "200-0-100.png": "h200"}
+	var names []string
+	for name := range frames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var manifest strings.Builder
+	for _, name := range names {
+		manifest.WriteString(name + " " + hashes[name] + "\n")
+	}
+
+	dirFiles := map[string][]byte{ManifestName: []byte(manifest.String()), "notes.txt": []byte("ignored")}
+	for name, b := range frames {
+		dirFiles[name] = b
+	}
+	dirPath := writeDir(t, dirFiles)
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, name := range append(names, ManifestName) {
+		b := frames[name]
+		if name == ManifestName {
+			b = []byte(manifest.String())
+		}
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg})
+		tw.Write(b)
+	}
+	tw.Close()
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for _, name := range names {
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: name, Comment: hashes[name]})
+		w.Write(frames[name])
+	}
+	zw.SetComment(PaletteComment("2017"))
+	zw.Close()
+
+	archives := writeDir(t, map[string][]byte{"frames.tar": tarBuf.Bytes(), "frames.zip": zipBuf.Bytes()})
+
+	for _, tc := range []struct {
+		path, palette string
+	}{
+		{dirPath, ""},
+		{filepath.Join(archives, "frames.tar"), ""},
+		{filepath.Join(archives, "frames.zip"), "2017"},
+	} {
+		t.Run(filepath.Base(tc.path), func(t *testing.T) {
+			s, err := OpenFrameStore(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			list := append([]string(nil), s.List()...)
+			sort.Strings(list)
+			if strings.Join(list, ",") != strings.Join(names, ",") {
+				t.Errorf("List = %v, want %v", list, names)
+			}
+			if p := s.Palette(); p != tc.palette {
+				t.Errorf("Palette = %q, want %q", p, tc.palette)
+			}
+			for _, name := range names {
+				if h := s.Hash(name); h != hashes[name] {
+					t.Errorf("Hash(%s) = %q, want %q", name, h, hashes[name])
+				}
+				r, err := s.Open(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(r)
+				r.Close()
+				if err != nil || !bytes.Equal(b, frames[name]) {
+					t.Errorf("Open(%s) read %d bytes, %v; want the stored %d", name, len(b), err, len(frames[name]))
+				}
+				if st, err := s.Stat(name); err != nil || st.Size() != int64(len(frames[name])) {
+					t.Errorf("Stat(%s) = %v, %v", name, st, err)
+				}
+			}
+			if _, err := s.Open("missing.png"); err == nil {
+				t.Error("Open of a missing frame succeeded")
+			}
+		})
+	}
+}
+
+func TestStorePalette(t *testing.T) {
+	p := *testProfile
+	p.Pal, p.Palette, p.Blank = palette.Palette2022, palette.Palette2022.Colors, 32
+
+	// index 1 is #FF4500 in the 16 color palette, and 3 in the final one
+	var spd bytes.Buffer
+	EncodeSparse(&spd, &Sparse{Rect: image.Rect(0, 0, 4, 4), Runs: []Run{{Off: 5, Pix: []uint8{1}}}})
+	key := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Palette2022v16.Colors)
+	for i := range key.Pix {
+		key.Pix[i] = 16
+	}
+	files := map[string][]byte{
+		"100-0.png":     encodePNG(t, key),
+		"200-0-100.spd": spd.Bytes(),
+		ManifestName:    []byte(PaletteComment("2022-16") + "\n"),
+	}
+	d, err := MakeDeltaReader(&p, writeDir(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	e := d.FileMap[0][200]
+	im, err := d.GetImage(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.Pix[5] != 3 || im.Pix[0] != 32 {
+		t.Errorf("pixels 5 and 0 = %d and %d, want 3 and 32", im.Pix[5], im.Pix[0])
+	}
+
+	for _, pal := range []string{"2017", "2023", "nonesuch"} {
+		files[ManifestName] = []byte(PaletteComment(pal) + "\n")
+		if _, err := MakeDeltaReader(&p, writeDir(t, files)); err == nil {
+			t.Errorf("frames with palette %s loaded onto 2022", pal)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package delta
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+
+	"golang.org/x/image/bmp"
+)
+
+// ImageHash is the integrity hash stored alongside each frame: the base32
+// SHA-1 of the image encoded as a BMP.
+func ImageHash(im image.Image) string {
+	h := sha1.New()
+	bmp.Encode(h, im)
+	return base32.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// VerifyFailure is a frame that couldn't be rebuilt or didn't match its
+// stored hash.
+type VerifyFailure struct {
+	Entry     DeltaReaderEntry
+	Want, Got string
+	Err       error
+}
+
+func (f VerifyFailure) String() string {
+	if f.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", f.Entry.Store, f.Entry.Name, f.Err)
+	}
+	return fmt.Sprintf("%s: %s: hash %s, want %s", f.Entry.Store, f.Entry.Name, f.Got, f.Want)
+}
+
+type VerifyResult struct {
+	// Checked counts frames rebuilt and compared to their stored hash.
+	Checked int
+	// Unhashed counts frames that have no stored hash.
+	Unhashed int
+	Failures []VerifyFailure
+}
+
+// Verify rebuilds every frame that has a stored hash and compares them.
+// progress, if not nil, is called after each frame. The returned error is
+// only set if ctx is cancelled; mismatches are reported in the result.
+func (d *DeltaReader) Verify(ctx context.Context, progress func(done, total int)) (*VerifyResult, error) {
+	type job struct {
+		e    DeltaReaderEntry
+		hash string
+	}
+	res := &VerifyResult{}
+	var jobs []job
+	for _, fs := range d.Files {
+		for _, e := range fs {
+			h := e.Store.Hash(e.Name)
+			if h == "" {
+				res.Unhashed++
+				continue
+			}
+			jobs = append(jobs, job{e, h})
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan job)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				f := VerifyFailure{Entry: j.e, Want: j.hash}
+				im, err := d.GetImage(&j.e)
+				if err != nil {
+					f.Err = err
+				} else {
+					f.Got = ImageHash(im)
+				}
+				mu.Lock()
+				res.Checked++
+				if f.Err != nil || f.Got != f.Want {
+					res.Failures = append(res.Failures, f)
+				}
+				if progress != nil {
+					progress(res.Checked, len(jobs))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for _, j := range jobs {
+		// select picks randomly when a worker is also ready
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		select {
+		case ch <- j:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	return res, err
+}
@@ -0,0 +1,52 @@
+package delta
+
+import (
+	"context"
+	"sort"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	frames := testFrames(t)
+	frames["150-1.png"] = []byte("not a png")
+	hashes := map[string]string{
+		"100-0.png":     ImageHash(testFrame(1, nil)),
+		"200-0-100.png": ImageHash(testFrame(1, map[int]uint8{0: 2})),
+		"300-0-200.png": "bogus",
+		"150-1.png":     ImageHash(testFrame(4, map[int]uint8{5: 6})),
+	}
+	d := writeZip(t, wideProfile, frames, hashes)
+
+	calls, last := 0, 0
+	res, err := d.Verify(context.Background(), func(done, total int) {
+		calls++
+		if total != 4 || done <= last {
+			t.Errorf("progress(%d, %d) after %d", done, total, last)
+		}
+		last = done
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Checked != 4 || res.Unhashed != 1 || calls != 4 {
+		t.Errorf("checked %d, unhashed %d, %d progress calls; want 4, 1 and 4", res.Checked, res.Unhashed, calls)
+	}
+
+	sort.Slice(res.Failures, func(i, j int) bool { return res.Failures[i].Entry.Name < res.Failures[j].Entry.Name })
+	if len(res.Failures) != 2 {
+		t.Fatalf("failures %v, want 2", res.Failures)
+	}
+	if f := res.Failures[0]; f.Entry.Name != "150-1.png" || f.Err == nil {
+		t.Errorf("failure %v, want a decode error for 150-1.png", f)
+	}
+	want := ImageHash(testFrame(1, map[int]uint8{0: 2, 1: 3}))
+	if f := res.Failures[1]; f.Entry.Name != "300-0-200.png" || f.Err != nil || f.Want != "bogus" || f.Got != want {
+		t.Errorf("failure %v, want a hash mismatch for 300-0-200.png", f)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.Verify(ctx, nil); err != context.Canceled {
+		t.Errorf("Verify after cancel: err %v, want %v", err, context.Canceled)
+	}
+}
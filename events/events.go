@@ -0,0 +1,348 @@
+// Package events reads the pixel change streams written by
+// cmd/eventsfromcanvas and cmd/eventsfromcanvas2: PIXELPAK files, with one
+// fixed size record per change, and the crunched PIXLPACK files served to the
+// web frontends.
+package events
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"github.com/rmmh/rplace/profile"
+)
+
+// Event is one pixel change. Colors are indexes into the profile palette.
+type Event struct {
+	Ts    int64
+	X, Y  int
+	Color uint8
+	// Prev is the color the pixel had before the change.
+	Prev uint8
+}
+
+// Reader yields events in time order. Next returns io.EOF after the last
+// event.
+type Reader interface {
+	Next() (Event, error)
+	Close() error
+}
+
+var ErrBadHeader = errors.New("not a PIXELPAK or PIXLPACK file")
+
+// Open reads the events of files one after another, as written by a split
+// crunch. The files must all be the same format.
+func Open(p *profile.Profile, paths ...string) (Reader, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no event files given")
+	}
+	r := &multiReader{p: p, paths: paths}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type multiReader struct {
+	p     *profile.Profile
+	paths []string
+	f     *os.File
+	cur   Reader
+	// state carries pixel colors between PIXLPACK splits
+	state []uint8
+}
+
+func (m *multiReader) open() error {
+	f, err := os.Open(m.paths[0])
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(f, 1<<16)
+	magic, err := br.Peek(8)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", m.paths[0], ErrBadHeader)
+	}
+	switch string(magic) {
+	case "PIXELPAK":
+		m.cur, err = NewPixelpakReader(br)
+	case "PIXLPACK":
+		var pr *PixlpackReader
+		pr, err = NewPixlpackReader(m.p, br, m.state)
+		if pr != nil {
+			m.state = pr.state
+		}
+		m.cur = pr
+	default:
+		err = ErrBadHeader
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", m.paths[0], err)
+	}
+	m.f = f
+	m.paths = m.paths[1:]
+	return nil
+}
+
+func (m *multiReader) Next() (Event, error) {
+	for {
+		if m.cur == nil {
+			return Event{}, io.EOF
+		}
+		e, err := m.cur.Next()
+		if err != io.EOF {
+			return e, err
+		}
+		m.f.Close()
+		m.f, m.cur = nil, nil
+		if len(m.paths) == 0 {
+			return Event{}, io.EOF
+		}
+		if err := m.open(); err != nil {
+			return Event{}, err
+		}
+	}
+}
+
+func (m *multiReader) Close() error {
+	if m.f == nil {
+		return nil
+	}
+	err := m.f.Close()
+	m.f, m.cur = nil, nil
+	return err
+}
+
+// PixelpakReader reads PIXELPAK files: the magic and a uint64 start time,
+// then 8 byte little endian records. The first 4 bytes hold 11 bits of x,
+// 11 bits of y, and 5 bits each of the new and old colors, less one. The
+// last 4 hold a 31 bit time offset, with the top bit holding x's 12th bit.
+type PixelpakReader struct {
+	r     io.Reader
+	start int64
+	buf   [8]byte
+}
+
+func NewPixelpakReader(r io.Reader) (*PixelpakReader, error) {
+	p := &PixelpakReader{r: r}
+	if _, err := io.ReadFull(r, p.buf[:]); err != nil || string(p.buf[:]) != "PIXELPAK" {
+		return nil, ErrBadHeader
+	}
+	if _, err := io.ReadFull(r, p.buf[:]); err != nil {
+		return nil, ErrBadHeader
+	}
+	p.start = int64(binary.LittleEndian.Uint64(p.buf[:]))
+	return p, nil
+}
+
+func (p *PixelpakReader) Next() (Event, error) {
+	if _, err := io.ReadFull(p.r, p.buf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return Event{}, err
+	}
+	packed := binary.LittleEndian.Uint32(p.buf[:4])
+	off := binary.LittleEndian.Uint32(p.buf[4:])
+	return Event{
+		Ts:    p.start + int64(off&0x7fffffff),
+		X:     int(packed&0x7ff | (off>>20)&0x800),
+		Y:     int((packed >> 11) & 0x7ff),
+		Color: uint8((packed>>22)&31) + 1,
+		Prev:  uint8((packed>>27)&31) + 1,
+	}, nil
+}
+
+func (p *PixelpakReader) Close() error { return nil }
+
+// PixlpackReader reads PIXLPACK files: the magic and a uint64 start time,
+// then groups of changes made at once to one 1000x500 octant of the canvas.
+// A group is a uvarint time since the previous group, a uvarint holding the
+// change count and the octant as given by the file's Layout, then 3 bytes per
+// change holding 10 bits of x, 9 bits of y and 5 bits of the old color xor
+// the new.
+type PixlpackReader struct {
+	r      *bufio.Reader
+	layout Layout
+	width  int
+	start  int64
+	ts     uint64
+	oct    int
+	left   int
+	state  []uint8
+}
+
+// Layout is how a PIXLPACK file packs each group's octant. Files don't
+// record it, so readers detect it from the groups at the start of the file.
+type Layout int
+
+const (
+	// Octants4 is written by cmd/eventsfromcanvas2 and read by web2: the
+	// count shifted left 4 bits plus octant y/500 + 4*(x/1000).
+	Octants4 Layout = iota
+	// Octants3 is written by cmd/eventsfromcanvas and read by web, and only
+	// covers canvases up to 2000x2000: the count shifted left 3 bits plus
+	// octant x/1000 + 2*(y/500).
+	Octants3
+)
+
+func (l Layout) String() string {
+	if l == Octants3 {
+		return "3 bit octants"
+	}
+	return "4 bit octants"
+}
+
+// group splits a group's uvarint into its change count and octant.
+func (l Layout) group(co uint64) (count, oct int) {
+	if l == Octants3 {
+		return int(co >> 3), int(co & 7)
+	}
+	return int(co >> 4), int(co & 15)
+}
+
+// origin is the top left corner of an octant.
+func (l Layout) origin(oct int) (x, y int) {
+	if l == Octants3 {
+		return 1000 * (oct % 2), 500 * (oct / 2)
+	}
+	return 1000 * (oct / 4), 500 * (oct % 4)
+}
+
+var ErrUnknownLayout = errors.New("PIXLPACK groups don't fit the canvas in any known layout")
+
+// detectLayout returns the first layout, in order of preference, under which
+// every change in the buffered groups at the start of br is on the canvas.
+// Reading a file in the wrong layout soon puts changes off the canvas: a
+// group with an odd count read as Octants4 starts at x 2000 or beyond, off
+// every canvas Octants3 can hold.
+func detectLayout(p *profile.Profile, br *bufio.Reader) (Layout, error) {
+	head, err := br.Peek(br.Size())
+	// if the whole rest of the file is buffered, it must end on a group
+	whole := err != nil
+	b := p.Bounds()
+	for _, l := range []Layout{Octants4, Octants3} {
+		if l == Octants3 && (b.Dx() > 2000 || b.Dy() > 2000) {
+			continue
+		}
+		if fitsLayout(l, head, whole, b) {
+			return l, nil
+		}
+	}
+	return 0, ErrUnknownLayout
+}
+
+// fitsLayout reports whether the groups in head are all nonempty and on the
+// canvas when read in layout l. A group cut off at the end of head fits
+// unless head is the whole file.
+func fitsLayout(l Layout, head []byte, whole bool, b image.Rectangle) bool {
+	for len(head) > 0 {
+		_, n := binary.Uvarint(head)
+		if n <= 0 {
+			return !whole
+		}
+		co, m := binary.Uvarint(head[n:])
+		if m <= 0 {
+			return !whole
+		}
+		head = head[n+m:]
+		count, oct := l.group(co)
+		if count == 0 {
+			return false
+		}
+		ox, oy := l.origin(oct)
+		for i := 0; i < count; i++ {
+			if len(head) < 3 {
+				return !whole
+			}
+			repack := uint32(head[0]) | uint32(head[1])<<8 | uint32(head[2])<<16
+			if !image.Pt(ox+int(repack&0x3ff), oy+int((repack>>10)&0x1ff)).In(b) {
+				return false
+			}
+			head = head[3:]
+		}
+	}
+	return true
+}
+
+// NewPixlpackReader reads a PIXLPACK file. As changes are stored relative to
+// the previous color, a file split from a longer stream must be given the
+// state left by the files before it; state may be nil for the first file.
+func NewPixlpackReader(p *profile.Profile, r io.Reader, state []uint8) (*PixlpackReader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(br, buf[:]); err != nil || string(buf[:]) != "PIXLPACK" {
+		return nil, ErrBadHeader
+	}
+	if _, err := io.ReadFull(br, buf[:]); err != nil {
+		return nil, ErrBadHeader
+	}
+	layout, err := detectLayout(p, br)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = make([]uint8, p.Width()*p.Height())
+		for i := range state {
+			state[i] = p.Blank - 1
+		}
+	}
+	return &PixlpackReader{
+		r:      br,
+		layout: layout,
+		width:  p.Width(),
+		start:  int64(binary.LittleEndian.Uint64(buf[:])),
+		state:  state,
+	}, nil
+}
+
+// Layout returns the layout the file was detected to have.
+func (p *PixlpackReader) Layout() Layout { return p.layout }
+
+func (p *PixlpackReader) Next() (Event, error) {
+	for p.left == 0 {
+		dt, err := binary.ReadUvarint(p.r)
+		if err != nil {
+			return Event{}, err
+		}
+		co, err := binary.ReadUvarint(p.r)
+		if err != nil {
+			return Event{}, io.ErrUnexpectedEOF
+		}
+		// the first group's time is absolute, as the delta is from 0
+		p.ts += dt
+		p.left, p.oct = p.layout.group(co)
+	}
+	var buf [3]byte
+	if _, err := io.ReadFull(p.r, buf[:]); err != nil {
+		return Event{}, io.ErrUnexpectedEOF
+	}
+	p.left--
+	repack := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16
+	ox, oy := p.layout.origin(p.oct)
+	x := int(repack&0x3ff) + ox
+	y := int((repack>>10)&0x1ff) + oy
+	o := x + y*p.width
+	if x >= p.width || o >= len(p.state) {
+		return Event{}, fmt.Errorf("event at (%d,%d) outside the canvas", x, y)
+	}
+	prev := p.state[o]
+	p.state[o] ^= uint8(repack>>19) & 31
+	return Event{
+		Ts:    p.start + int64(p.ts),
+		X:     x,
+		Y:     y,
+		Color: p.state[o] + 1,
+		Prev:  prev + 1,
+	}, nil
+}
+
+func (p *PixlpackReader) Close() error { return nil }
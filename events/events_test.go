@@ -0,0 +1,199 @@
+package events
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rmmh/rplace/profile"
+)
+
+func mustProfile(t *testing.T, name string) *profile.Profile {
+	t.Helper()
+	p, err := profile.Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func header(magic string, start uint64) []byte {
+	return binary.LittleEndian.AppendUint64([]byte(magic), start)
+}
+
+// pixelpak encodes events as cmd/eventsfromcanvas2 writes them.
+func pixelpak(start uint64, evs []Event) []byte {
+	b := header("PIXELPAK", start)
+	for _, e := range evs {
+		packed := uint32(e.X&0x7ff) | uint32(e.Y)<<11 | uint32(e.Color-1)<<22 | uint32(e.Prev-1)<<27
+		off := uint32(e.Ts-int64(start)) | uint32(e.X&0x800)<<20
+		b = binary.LittleEndian.AppendUint32(b, packed)
+		b = binary.LittleEndian.AppendUint32(b, off)
+	}
+	return b
+}
+
+// pixlpack crunches events as the tool writing layout l does, one group per
+// run of events at the same time in the same octant.
+func pixlpack(l Layout, start uint64, evs []Event) []byte {
+	b := header("PIXLPACK", start)
+	octant := func(e Event) int {
+		if l == Octants3 {
+			return e.X/1000 + 2*(e.Y/500)
+		}
+		return e.Y/500 + 4*(e.X/1000)
+	}
+	shift := 4
+	if l == Octants3 {
+		shift = 3
+	}
+	last := int64(0)
+	for i := 0; i < len(evs); {
+		j := i + 1
+		for j < len(evs) && evs[j].Ts == evs[i].Ts && octant(evs[j]) == octant(evs[i]) {
+			j++
+		}
+		ts := evs[i].Ts - int64(start)
+		b = binary.AppendUvarint(b, uint64(ts-last))
+		b = binary.AppendUvarint(b, uint64((j-i)<<shift+octant(evs[i])))
+		last = ts
+		for _, e := range evs[i:j] {
+			repack := uint32(e.X%1000) | uint32(e.Y%500)<<10 | uint32((e.Color-1)^(e.Prev-1))<<19
+			b = append(b, byte(repack), byte(repack>>8), byte(repack>>16))
+		}
+		i = j
+	}
+	return b
+}
+
+func readAll(t *testing.T, r Reader) []Event {
+	t.Helper()
+	var evs []Event
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return evs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, e)
+	}
+}
+
+func sameEvents(t *testing.T, got, want []Event) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("read %d events, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func writeFile(t *testing.T, dir, name string, b []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testEvents is a history in which every change's Prev is the pixel's last
+// color, starting from blank. It has odd and even group sizes in several
+// octants.
+func testEvents(p *profile.Profile, start int64) []Event {
+	pix := map[[2]int]uint8{}
+	var evs []Event
+	add := func(ts int64, x, y int, c uint8) {
+		prev, ok := pix[[2]int{x, y}]
+		if !ok {
+			prev = p.Blank
+		}
+		pix[[2]int{x, y}] = c
+		evs = append(evs, Event{Ts: start + ts, X: x, Y: y, Color: c, Prev: prev})
+	}
+	add(0, 10, 20, 3)
+	add(0, 11, 20, 4)
+	add(5, 1500, 20, 5)
+	add(5, 999, 1999, 6)
+	add(5, 998, 1999, 7)
+	add(9, 10, 20, 8)
+	add(9, 1999, 1999, 2)
+	add(12, p.Width()-1, 700, 9)
+	return evs
+}
+
+func TestPixelpak(t *testing.T) {
+	p := mustProfile(t, "2023")
+	evs := testEvents(p, 1000)
+	r, err := Open(p, writeFile(t, t.TempDir(), "events.bin", pixelpak(1000, evs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	sameEvents(t, readAll(t, r), evs)
+}
+
+func TestPixlpackLayouts(t *testing.T) {
+	for _, tc := range []struct {
+		profile string
+		layout  Layout
+	}{
+		{"2022", Octants3},
+		{"2022", Octants4},
+		{"2023", Octants4},
+	} {
+		t.Run(tc.profile+" "+tc.layout.String(), func(t *testing.T) {
+			p := mustProfile(t, tc.profile)
+			evs := testEvents(p, 1000)
+			r, err := NewPixlpackReader(p, bytes.NewReader(pixlpack(tc.layout, 1000, evs)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Layout() != tc.layout {
+				t.Fatalf("detected %s", r.Layout())
+			}
+			sameEvents(t, readAll(t, r), evs)
+		})
+	}
+}
+
+func TestPixlpackUnknownLayout(t *testing.T) {
+	p := mustProfile(t, "2017")
+	// a change in the second column of 3 bit octants, on a 1000x1000 canvas
+	evs := []Event{{Ts: 0, X: 1500, Y: 20, Color: 2, Prev: 1}}
+	_, err := NewPixlpackReader(p, bytes.NewReader(pixlpack(Octants3, 0, evs)), nil)
+	if !errors.Is(err, ErrUnknownLayout) {
+		t.Errorf("err = %v, want ErrUnknownLayout", err)
+	}
+}
+
+func TestPixlpackSplit(t *testing.T) {
+	p := mustProfile(t, "2022")
+	evs := testEvents(p, 1000)
+	// later files carry on from the pixel colors the earlier ones left
+	dir := t.TempDir()
+	a := writeFile(t, dir, "events.000.bin", pixlpack(Octants3, 1000, evs[:5]))
+	b := writeFile(t, dir, "events.001.bin", pixlpack(Octants3, 1000, evs[5:]))
+	r, err := Open(p, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	sameEvents(t, readAll(t, r), evs)
+}
+
+func TestOpenBadHeader(t *testing.T) {
+	p := mustProfile(t, "2022")
+	if _, err := Open(p, writeFile(t, t.TempDir(), "x.bin", []byte("NOTEVENTS..."))); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("err = %v, want ErrBadHeader", err)
+	}
+}
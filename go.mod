@@ -1,6 +1,6 @@
 module github.com/rmmh/rplace
 
-go 1.18
+go 1.20
 
 require (
 	github.com/gorilla/mux v1.8.0
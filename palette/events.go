@@ -0,0 +1,46 @@
+package palette
+
+// The times 2022's palette grew are approximate, taken from when the new
+// colors first show up in the archived frames.
+var (
+	Palette2017 = newPalette("2017", "2017", 1490918400000,
+		"#FFFFFF", "#E4E4E4", "#888888", "#222222", "#FFA7D1", "#E50000", "#E59500", "#A06A42",
+		"#E5D900", "#94E044", "#02BE01", "#00D3DD", "#0083C7", "#0000EA", "#CF6EE4", "#820080",
+	)
+
+	Palette2022v16 = newPalette("2022-16", "2022", 1648817050351,
+		"#FF4500", "#FFA800", "#FFD635", "#00A368", "#7EED56", "#2450A4", "#3690EA", "#51E9F4",
+		"#811E9F", "#B44AC0", "#FF99AA", "#9C6926", "#000000", "#898D90", "#D4D7D9", "#FFFFFF",
+	)
+
+	Palette2022v24 = newPalette("2022-24", "2022", 1648922400000,
+		"#BE0039", "#FF4500", "#FFA800", "#FFD635", "#00A368", "#00CC78", "#7EED56", "#009EAA",
+		"#2450A4", "#3690EA", "#51E9F4", "#493AC1", "#6A5CFF", "#811E9F", "#B44AC0", "#FF3881",
+		"#FF99AA", "#6D482F", "#9C6926", "#000000", "#515252", "#898D90", "#D4D7D9", "#FFFFFF",
+	)
+
+	Palette2022 = newPalette("2022", "2022", 1649012400000,
+		"#6D001A", "#BE0039", "#FF4500", "#FFA800", "#FFD635", "#FFF8B8", "#00A368", "#00CC78",
+		"#7EED56", "#00756F", "#009EAA", "#00CCC0", "#2450A4", "#3690EA", "#51E9F4", "#493AC1",
+		"#6A5CFF", "#94B3FF", "#811E9F", "#B44AC0", "#E4ABFF", "#DE107F", "#FF3881", "#FF99AA",
+		"#6D482F", "#9C6926", "#FFB470", "#000000", "#515252", "#898D90", "#D4D7D9", "#FFFFFF",
+	)
+
+	// 2023 offered a different subset of these colors each day. Its frames
+	// are archived against the full set and no daily subset changes an
+	// index, so the subsets aren't registered as versions.
+	Palette2023 = newPalette("2023", "2023", 1689858080999,
+		"#6D001A", "#BE0039", "#FF4500", "#FFA800", "#FFD635", "#FFF8B8", "#00A368", "#00CC78",
+		"#7EED56", "#00756F", "#009EAA", "#00CCC0", "#2450A4", "#3690EA", "#51E9F4", "#493AC1",
+		"#6A5CFF", "#94B3FF", "#811E9F", "#B44AC0", "#E4ABFF", "#DE107F", "#FF3881", "#FF99AA",
+		"#6D482F", "#9C6926", "#FFB470", "#000000", "#515252", "#898D90", "#D4D7D9", "#FFFFFF",
+	)
+)
+
+func init() {
+	Register(Palette2017)
+	Register(Palette2022v16)
+	Register(Palette2022v24)
+	Register(Palette2022)
+	Register(Palette2023)
+}
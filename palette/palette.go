@@ -0,0 +1,150 @@
+// Package palette holds the color palettes used by each r/place event,
+// including the versions that were in effect as the palette grew mid-event.
+//
+// Every palette stores transparency at index 0, followed by the canvas
+// colors in the order the event listed them, so a Palette's Colors can be
+// used directly as an image palette. Archived frames and event files use the
+// indexes of an event's latest palette, except for sparse deltas in frame
+// stores that record an earlier version, which are remapped with Remap.
+package palette
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strings"
+)
+
+type Palette struct {
+	// Name identifies the version, such as "2022-24".
+	Name string
+	// Event is the r/place event the palette belongs to, such as "2022".
+	Event string
+	// Since is when the version took effect, in Unix milliseconds.
+	Since  int64
+	Colors color.Palette
+
+	index map[string]uint8
+}
+
+func newPalette(name, event string, since int64, hexes ...string) *Palette {
+	p := &Palette{
+		Name:   name,
+		Event:  event,
+		Since:  since,
+		Colors: color.Palette{color.NRGBA{}},
+		index:  map[string]uint8{},
+	}
+	for _, h := range hexes {
+		c, err := ParseHex(h)
+		if err != nil {
+			panic(err)
+		}
+		p.index[Hex(c)] = uint8(len(p.Colors))
+		p.Colors = append(p.Colors, c)
+	}
+	return p
+}
+
+// Len is the number of canvas colors, not counting transparency.
+func (p *Palette) Len() int {
+	return len(p.Colors) - 1
+}
+
+// Hex returns the "#RRGGBB" form of color index i, or "" for transparency
+// and indexes outside the palette.
+func (p *Palette) Hex(i uint8) string {
+	if i == 0 || int(i) >= len(p.Colors) {
+		return ""
+	}
+	return Hex(p.Colors[i])
+}
+
+// Index returns the index of a "#RRGGBB" color, in either case.
+func (p *Palette) Index(hex string) (uint8, bool) {
+	i, ok := p.index[strings.ToUpper(hex)]
+	return i, ok
+}
+
+// IndexColor returns the index of an exact, opaque color.
+func (p *Palette) IndexColor(c color.Color) (uint8, bool) {
+	if _, _, _, a := c.RGBA(); a != 0xffff {
+		return 0, a == 0
+	}
+	return p.Index(Hex(c))
+}
+
+func (p *Palette) String() string {
+	return p.Name
+}
+
+// Hex formats a color as "#RRGGBB", ignoring alpha.
+func Hex(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02X%02X%02X", r>>8, g>>8, b>>8)
+}
+
+// ParseHex parses an opaque "#RRGGBB" color.
+func ParseHex(s string) (color.RGBA, error) {
+	var c color.RGBA
+	if len(s) != 7 || s[0] != '#' {
+		return c, fmt.Errorf("bad color %q", s)
+	}
+	_, err := fmt.Sscanf(s[1:], "%02x%02x%02x", &c.R, &c.G, &c.B)
+	if err != nil {
+		return c, fmt.Errorf("bad color %q", s)
+	}
+	c.A = 0xff
+	return c, nil
+}
+
+// Remap returns a table mapping each index of from to the index of the same
+// color in to. Transparency maps to transparency. It fails if to lacks any
+// of from's colors.
+func Remap(from, to *Palette) ([]uint8, error) {
+	table := make([]uint8, len(from.Colors))
+	for i := 1; i < len(from.Colors); i++ {
+		j, ok := to.Index(from.Hex(uint8(i)))
+		if !ok {
+			return nil, fmt.Errorf("palette %s has no color %s from %s", to, from.Hex(uint8(i)), from)
+		}
+		table[i] = j
+	}
+	return table, nil
+}
+
+// Apply rewrites pix in place through a table returned by Remap.
+func Apply(table []uint8, pix []uint8) {
+	for i, c := range pix {
+		pix[i] = table[c]
+	}
+}
+
+var palettes = map[string]*Palette{}
+
+// Register adds a palette version to the registry.
+func Register(p *Palette) {
+	if _, ok := palettes[p.Name]; ok {
+		panic("duplicate palette " + p.Name)
+	}
+	palettes[p.Name] = p
+}
+
+// Lookup finds a palette version by name.
+func Lookup(name string) (*Palette, error) {
+	p, ok := palettes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown palette %q (have %v)", name, Names())
+	}
+	return p, nil
+}
+
+// Names lists every registered palette version.
+func Names() []string {
+	names := make([]string, 0, len(palettes))
+	for n := range palettes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
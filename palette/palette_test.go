@@ -0,0 +1,121 @@
+package palette
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestIndexHex(t *testing.T) {
+	for _, tc := range []struct {
+		p   *Palette
+		hex string
+		i   uint8
+		ok  bool
+	}{
+		{Palette2017, "#FFFFFF", 1, true},
+		{Palette2017, "#820080", 16, true},
+		{Palette2022, "#6d001a", 1, true},
+		{Palette2022, "#FFFFFF", 32, true},
+		{Palette2022v16, "#6D001A", 0, false},
+	} {
+		i, ok := tc.p.Index(tc.hex)
+		if i != tc.i || ok != tc.ok {
+			t.Errorf("%s.Index(%s) = %d, %v; want %d, %v", tc.p, tc.hex, i, ok, tc.i, tc.ok)
+		}
+		if ok {
+			if h := tc.p.Hex(i); h != Hex(mustParse(t, tc.hex)) {
+				t.Errorf("%s.Hex(%d) = %s, want %s", tc.p, i, h, tc.hex)
+			}
+		}
+	}
+	if h := Palette2017.Hex(0); h != "" {
+		t.Errorf("Hex(0) = %q, want transparency to have none", h)
+	}
+	if h := Palette2017.Hex(17); h != "" {
+		t.Errorf("Hex past the end = %q, want none", h)
+	}
+}
+
+func mustParse(t *testing.T, s string) color.RGBA {
+	t.Helper()
+	c, err := ParseHex(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestParseHex(t *testing.T) {
+	for _, s := range []string{"", "FFFFFF", "#FFF", "#GGGGGG", "#FFFFFFFF"} {
+		if _, err := ParseHex(s); err == nil {
+			t.Errorf("ParseHex(%q) succeeded", s)
+		}
+	}
+	if c := mustParse(t, "#0083c7"); c != (color.RGBA{0x00, 0x83, 0xc7, 0xff}) {
+		t.Errorf("ParseHex = %v", c)
+	}
+}
+
+func TestIndexColor(t *testing.T) {
+	for _, tc := range []struct {
+		c  color.Color
+		i  uint8
+		ok bool
+	}{
+		{color.RGBA{0xff, 0xff, 0xff, 0xff}, 1, true},
+		{color.NRGBA{}, 0, true},
+		{color.NRGBA{0xff, 0xff, 0xff, 0x80}, 0, false},
+		{color.RGBA{1, 2, 3, 0xff}, 0, false},
+	} {
+		i, ok := Palette2017.IndexColor(tc.c)
+		if i != tc.i || ok != tc.ok {
+			t.Errorf("IndexColor(%v) = %d, %v; want %d, %v", tc.c, i, ok, tc.i, tc.ok)
+		}
+	}
+}
+
+func TestRemap(t *testing.T) {
+	// each 2022 version only adds colors, so earlier versions map onto later
+	for _, pair := range [][2]*Palette{
+		{Palette2022v16, Palette2022v24},
+		{Palette2022v24, Palette2022},
+		{Palette2022v16, Palette2022},
+	} {
+		from, to := pair[0], pair[1]
+		table, err := Remap(from, to)
+		if err != nil {
+			t.Fatalf("Remap(%s, %s): %v", from, to, err)
+		}
+		pix := make([]uint8, len(from.Colors))
+		for i := range pix {
+			pix[i] = uint8(i)
+		}
+		Apply(table, pix)
+		if pix[0] != 0 {
+			t.Errorf("%s->%s: transparency maps to %d", from, to, pix[0])
+		}
+		for i := 1; i < len(pix); i++ {
+			if to.Hex(pix[i]) != from.Hex(uint8(i)) {
+				t.Errorf("%s->%s: %d (%s) maps to %d (%s)", from, to, i, from.Hex(uint8(i)), pix[i], to.Hex(pix[i]))
+			}
+		}
+	}
+	if _, err := Remap(Palette2022, Palette2022v16); err == nil {
+		t.Error("Remap onto a palette missing colors succeeded")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, name := range Names() {
+		p, err := Lookup(name)
+		if err != nil || p.Name != name {
+			t.Errorf("Lookup(%s) = %v, %v", name, p, err)
+		}
+		if p.Colors[0] != (color.NRGBA{}) {
+			t.Errorf("%s: index 0 is %v, not transparent", name, p.Colors[0])
+		}
+	}
+	if _, err := Lookup("1999"); err == nil {
+		t.Error("Lookup of an unknown palette succeeded")
+	}
+}
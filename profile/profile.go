@@ -0,0 +1,115 @@
+// Package profile describes the canvas layout of each r/place event.
+package profile
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+
+	"github.com/rmmh/rplace/palette"
+)
+
+// Profile is the geometry, palette and time range of one r/place event.
+// Frames are stored per canvas tile, and tiles are placed on the full canvas
+// at their offsets.
+type Profile struct {
+	Name string
+	// Canvases is the number of separately stored canvas tiles.
+	Canvases              int
+	TileWidth, TileHeight int
+	// Offsets is the position of each canvas tile on the full canvas.
+	Offsets []image.Point
+	// Pal is the palette version of stored frames and event files, and
+	// Palette its colors. Index 0 is transparent, so deltas can mark
+	// unchanged pixels.
+	Pal     *palette.Palette
+	Palette color.Palette
+	// Blank is the palette index of a pixel that has never been placed.
+	Blank uint8
+	// Start and End bound the event in Unix milliseconds.
+	Start, End int64
+}
+
+// Bounds is the rectangle covered by the full canvas.
+func (p *Profile) Bounds() image.Rectangle {
+	var r image.Rectangle
+	for c := 0; c < p.Canvases; c++ {
+		r = r.Union(p.TileRect(c))
+	}
+	return r
+}
+
+func (p *Profile) Width() int  { return p.Bounds().Dx() }
+func (p *Profile) Height() int { return p.Bounds().Dy() }
+
+// TileRect is the rectangle a canvas tile covers on the full canvas.
+func (p *Profile) TileRect(canvas int) image.Rectangle {
+	o := p.Offsets[canvas]
+	return image.Rect(o.X, o.Y, o.X+p.TileWidth, o.Y+p.TileHeight)
+}
+
+// CanvasAt returns the canvas tile holding full canvas point (x, y), or -1.
+func (p *Profile) CanvasAt(x, y int) int {
+	pt := image.Pt(x, y)
+	for c := 0; c < p.Canvases; c++ {
+		if pt.In(p.TileRect(c)) {
+			return c
+		}
+	}
+	return -1
+}
+
+var Profiles = map[string]*Profile{
+	"2017": {
+		Name:     "2017",
+		Canvases: 1, TileWidth: 1000, TileHeight: 1000,
+		Offsets: []image.Point{{0, 0}},
+		Pal:     palette.Palette2017,
+		Palette: palette.Palette2017.Colors,
+		Blank:   1,
+		Start:   1490918400000,
+		End:     1491238800000,
+	},
+	"2022": {
+		Name:     "2022",
+		Canvases: 4, TileWidth: 1000, TileHeight: 1000,
+		Offsets: []image.Point{{0, 0}, {1000, 0}, {0, 1000}, {1000, 1000}},
+		Pal:     palette.Palette2022,
+		Palette: palette.Palette2022.Colors,
+		Blank:   32,
+		Start:   1648817050351,
+		End:     1649116800000,
+	},
+	"2023": {
+		Name:     "2023",
+		Canvases: 6, TileWidth: 1000, TileHeight: 1000,
+		Offsets: []image.Point{{0, 0}, {1000, 0}, {2000, 0}, {0, 1000}, {1000, 1000}, {2000, 1000}},
+		Pal:     palette.Palette2023,
+		Palette: palette.Palette2023.Colors,
+		Blank:   32,
+		Start:   1689858080999,
+		End:     1690320892999,
+	},
+}
+
+// Default is the profile commands use when -profile isn't given.
+const Default = "2023"
+
+// Names lists the known profiles.
+func Names() []string {
+	names := make([]string, 0, len(Profiles))
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Lookup(name string) (*Profile, error) {
+	p, ok := Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q (have %v)", name, Names())
+	}
+	return p, nil
+}
@@ -0,0 +1,55 @@
+package profile
+
+import (
+	"image"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		canvases      int
+		width, height int
+	}{
+		{"2017", 1, 1000, 1000},
+		{"2022", 4, 2000, 2000},
+		{"2023", 6, 3000, 2000},
+	} {
+		p, err := Lookup(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Canvases != tc.canvases || len(p.Offsets) != p.Canvases {
+			t.Errorf("%s: %d canvases with %d offsets, want %d", tc.name, p.Canvases, len(p.Offsets), tc.canvases)
+		}
+		if p.Width() != tc.width || p.Height() != tc.height {
+			t.Errorf("%s: %dx%d, want %dx%d", tc.name, p.Width(), p.Height(), tc.width, tc.height)
+		}
+		if p.Start >= p.End {
+			t.Errorf("%s: starts at %d, after its end %d", tc.name, p.Start, p.End)
+		}
+		if int(p.Blank) >= len(p.Palette) || p.Palette[0] == nil {
+			t.Errorf("%s: blank index %d outside its palette", tc.name, p.Blank)
+		}
+		// every point of the canvas is on exactly the tile CanvasAt reports
+		for c := 0; c < p.Canvases; c++ {
+			r := p.TileRect(c)
+			for _, pt := range []image.Point{r.Min, r.Max.Sub(image.Pt(1, 1))} {
+				if got := p.CanvasAt(pt.X, pt.Y); got != c {
+					t.Errorf("%s: CanvasAt(%v) = %d, want %d", tc.name, pt, got, c)
+				}
+			}
+			for d := c + 1; d < p.Canvases; d++ {
+				if r.Overlaps(p.TileRect(d)) {
+					t.Errorf("%s: canvases %d and %d overlap", tc.name, c, d)
+				}
+			}
+		}
+		if got := p.CanvasAt(p.Width(), 0); got != -1 {
+			t.Errorf("%s: CanvasAt off the canvas = %d, want -1", tc.name, got)
+		}
+	}
+	if _, err := Lookup("1999"); err == nil {
+		t.Error("Lookup of an unknown profile succeeded")
+	}
+}